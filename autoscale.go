@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	. "github.com/byrnedo/capitan/logger"
+	"github.com/codegangsta/cli"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Sample cpu usage of every service with an autoscale policy and scale it
+// towards its cpu target, using the same code path as the `scale` command.
+//
+// A service is not scaled again until cooldown has passed. Runs until
+// interrupted.
+func runAutoscaler(interval time.Duration, cooldown time.Duration) {
+	lastScaled := make(map[string]time.Time)
+	for {
+		if err := autoscaleOnce(lastScaled, cooldown); err != nil {
+			Warning.Println("Autoscale failed:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func autoscaleOnce(lastScaled map[string]time.Time, cooldown time.Duration) error {
+	settings, err := loadSettings(args)
+	if err != nil {
+		return err
+	}
+
+	autoscaled := settings.ContainerList.Filter(func(i *container.Container) bool {
+		return i.Autoscale != nil
+	})
+	if len(autoscaled) == 0 {
+		Debug.Println("No services with an autoscale policy")
+		return nil
+	}
+
+	sample, err := autoscaled.SampleStats()
+	if err != nil {
+		return err
+	}
+
+	for _, stats := range sample.Services {
+		ctr := autoscaled.Filter(func(i *container.Container) bool {
+			return i.ServiceType == stats.ServiceType
+		})[0]
+
+		desired := desiredScale(ctr.Autoscale, stats.Instances, stats.CPUPercent)
+		Debug.Printf("%s: %d running, %.2f%% cpu, desired scale %d\n", stats.ServiceType, stats.Instances, stats.CPUPercent, desired)
+		if desired == ctr.Scale {
+			continue
+		}
+		if since := time.Since(lastScaled[stats.ServiceType]); since < cooldown {
+			Debug.Println(stats.ServiceType, "in cooldown for another", cooldown-since)
+			continue
+		}
+
+		Info.Printf("Autoscaling %s from %d to %d instances (%.2f%% cpu across %d running, target %.2f%% each)\n",
+			stats.ServiceType, ctr.Scale, desired, stats.CPUPercent, stats.Instances, ctr.Autoscale.CPUTarget)
+		if err := scaleService(cli.Args{stats.ServiceType, strconv.Itoa(desired)}); err != nil {
+			Warning.Println("Failed to scale", stats.ServiceType+":", err)
+			continue
+		}
+		lastScaled[stats.ServiceType] = time.Now()
+	}
+	return nil
+}
+
+// The number of instances needed to bring average cpu per instance to the
+// policy's target, within its bounds
+func desiredScale(policy *container.AutoscalePolicy, running int, totalCPU float64) int {
+	desired := policy.Min
+	if running > 0 && policy.CPUTarget > 0 {
+		desired = int(math.Ceil(totalCPU / policy.CPUTarget))
+	}
+	if desired < policy.Min {
+		desired = policy.Min
+	}
+	if desired > policy.Max {
+		desired = policy.Max
+	}
+	if desired < 1 {
+		desired = 1
+	}
+	return desired
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	"testing"
+	"time"
+)
+
+func TestDesiredScale(t *testing.T) {
+	policy := &container.AutoscalePolicy{Min: 2, Max: 5, CPUTarget: 50}
+	tests := []struct {
+		name     string
+		policy   *container.AutoscalePolicy
+		running  int
+		totalCPU float64
+		want     int
+	}{
+		{"on target", policy, 3, 150, 3},
+		{"scale up", policy, 2, 160, 4},
+		{"scale down", policy, 4, 90, 2},
+		{"rounds up", policy, 3, 151, 4},
+		{"clamped to max", policy, 5, 900, 5},
+		{"clamped to min", policy, 3, 10, 2},
+		{"idle", policy, 3, 0, 2},
+		{"nothing running", policy, 0, 0, 2},
+		{"no target", &container.AutoscalePolicy{Min: 3, Max: 5}, 4, 300, 3},
+		{"never below one", &container.AutoscalePolicy{Min: 0, Max: 5, CPUTarget: 50}, 2, 0, 1},
+	}
+	for _, test := range tests {
+		if got := desiredScale(test.policy, test.running, test.totalCPU); got != test.want {
+			t.Errorf("%s: desiredScale(%d running, %.0f%% cpu) = %d, want %d", test.name, test.running, test.totalCPU, got, test.want)
+		}
+	}
+}
+
+// Two busy instances of app, in the columns capitan's ps and stats
+// --format ask for
+const autoscaleDocker = `case "$1" in
+  ps)
+    printf 'id1\tdemo_app_1\t\tdemo_app\t1\tUp 2 minutes\thash\tapp\n'
+    printf 'id2\tdemo_app_2\t\tdemo_app\t2\tUp 2 minutes\thash\tapp\n'
+    ;;
+  stats)
+    printf 'demo_app_1\t95.00%%\t10MiB / 1GiB\t1kB / 2kB\n'
+    printf 'demo_app_2\t85.00%%\t10MiB / 1GiB\t1kB / 2kB\n'
+    ;;
+  inspect)
+    case "$*" in
+      *State.Running*) echo true;;
+      *) echo sha256:abc;;
+    esac
+    ;;
+esac`
+
+const autoscaleConfig = `global project demo
+app image nginx
+app scale 2
+app autoscale 1 5 60`
+
+func TestAutoscaleOnceRecordsScale(t *testing.T) {
+	_, restore := fakeDocker(t, autoscaleDocker, autoscaleConfig)
+	defer restore()
+
+	lastScaled := make(map[string]time.Time)
+	if err := autoscaleOnce(lastScaled, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := loadProjectState(stateFile, "demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 180% cpu over a 60% target
+	if state.Scale["app"] != 3 {
+		t.Fatalf("recorded scale %d, want 3", state.Scale["app"])
+	}
+	if lastScaled["app"].IsZero() {
+		t.Error("scale time not recorded for the cooldown")
+	}
+}
+
+func TestAutoscaleOnceCooldown(t *testing.T) {
+	_, restore := fakeDocker(t, autoscaleDocker, autoscaleConfig)
+	defer restore()
+
+	lastScaled := map[string]time.Time{"app": time.Now()}
+	if err := autoscaleOnce(lastScaled, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := loadProjectState(stateFile, "demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scale, found := state.Scale["app"]; found {
+		t.Fatalf("scaled to %d during the cooldown", scale)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/byrnedo/capitan/logger"
+	"sync"
+)
+
+// Deploy the new run arguments to the first canary-count instances of a
+// service as the other colour, and run the verify.canary hook against each.
+//
+// If every canary passes, the old canary containers are removed and the rest
+// of the service is updated. Otherwise the canaries are removed and the old
+// instances are left running.
+func (settings SettingsList) canaryUpdate(attach bool, dryRun bool, wg *sync.WaitGroup) error {
+	var (
+		first = settings[0]
+		count = first.CanaryCount
+	)
+	if count > len(settings) {
+		count = len(settings)
+	}
+	canaries, rest := settings[:count], settings[count:]
+
+	ContainerInfoLog(first.ServiceName, fmt.Sprintf("Run arguments changed, deploying %d canary instance(s)...", count))
+	newCons, err := canaries.runNewColors(attach, dryRun, wg)
+	if err != nil {
+		return err
+	}
+
+	for _, newCon := range newCons {
+		ContainerInfoLog(newCon.Name, "Verifying canary...")
+		if dryRun {
+			continue
+		}
+		if err := newCon.Hooks.Run("verify.canary", newCon); err != nil {
+			Warning.Println("Canary verification failed, reverting...")
+			newCons.discard(dryRun)
+			return errors.New("Canary verification failed for " + newCon.Name + ": " + err.Error())
+		}
+	}
+
+	if err := canaries.removeOldColors(newCons, dryRun); err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+
+	ContainerInfoLog(first.ServiceName, "Canaries verified, updating remaining instances...")
+	if first.UpdateParallelism > 0 {
+		return rest.rollingUpdate(attach, dryRun, wg)
+	}
+	for _, set := range rest {
+		if err := set.Redeploy(attach, dryRun, wg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
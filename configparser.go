@@ -14,9 +14,14 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 	"unicode"
 )
 
+// Hook scripts starting with this reference a global hook-def
+const hookDefPrefix = "@"
+
 type ConfigParser struct {
 	// command to obtain config from
 	Command string
@@ -24,13 +29,16 @@ type ConfigParser struct {
 	Args cli.Args
 	// the container filter
 	Filter string
+	// file holding runtime state such as scale overrides
+	StateFile string
 }
 
-func NewSettingsParser(cmd string, args cli.Args, filter string) *ConfigParser {
+func NewSettingsParser(cmd string, args cli.Args, filter string, stateFile string) *ConfigParser {
 	return &ConfigParser{
-		Command: cmd,
-		Args:    args,
-		Filter:  filter,
+		Command:   cmd,
+		Args:      args,
+		Filter:    filter,
+		StateFile: stateFile,
 	}
 }
 
@@ -80,6 +88,8 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 	projSettings.ProjectName = projNameArr[len(projNameArr)-1]
 	projSettings.ProjectSeparator = "_"
 	projSettings.Hooks = make(Hooks)
+	projSettings.ContainerHooks = make(container.Hooks)
+	projSettings.HookDefs = make(map[string]string)
 
 	for lineNum, line := range lines {
 
@@ -103,6 +113,22 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 					projSettings.ProjectSeparator = stripChars(string(lineParts[2]), " \t")
 				case "blue_green":
 					projSettings.BlueGreenMode, _ = strconv.ParseBool(string(lineParts[2]))
+				case "network":
+					networkArgs := str.ToArgv(string(lineParts[2]))
+					if len(networkArgs) > 0 {
+						projSettings.Networks = append(projSettings.Networks, &Network{
+							Name: networkArgs[0],
+							Args: networkArgs[1:],
+						})
+					}
+				case "volume":
+					volumeArgs := str.ToArgv(string(lineParts[2]))
+					if len(volumeArgs) > 0 {
+						projSettings.Volumes = append(projSettings.Volumes, &Volume{
+							Name: volumeArgs[0],
+							Args: volumeArgs[1:],
+						})
+					}
 				case "hook":
 					hookAndCommand := bytes.SplitN(lineParts[2], []byte{' '}, 2)
 					if len(hookAndCommand) == 2 {
@@ -115,6 +141,35 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 						hook.Scripts = append(hook.Scripts, hookScript)
 						projSettings.Hooks[hookName] = hook
 					}
+				case "hook-options":
+					optionArgs := strings.Fields(string(lineParts[2]))
+					if len(optionArgs) == 0 {
+						continue
+					}
+					hook := projSettings.Hooks[optionArgs[0]]
+					if hook == nil {
+						hook = new(Hook)
+					}
+					if err := container.ParseHookOptions(optionArgs[1:], &hook.Options, true); err != nil {
+						return projSettings, errors.New(fmt.Sprintf("Failed to parse `hook-options` on line %d, %s", lineNum+1, err))
+					}
+					projSettings.Hooks[optionArgs[0]] = hook
+				case "hook-def":
+					nameAndBody := bytes.SplitN(lineParts[2], []byte{' '}, 2)
+					if len(nameAndBody) == 2 {
+						projSettings.HookDefs[string(nameAndBody[0])] = string(nameAndBody[1])
+					}
+				case "container-hook":
+					hookAndCommand := bytes.SplitN(lineParts[2], []byte{' '}, 2)
+					if len(hookAndCommand) == 2 {
+						hookName := string(hookAndCommand[0])
+						hook := projSettings.ContainerHooks[hookName]
+						if hook == nil {
+							hook = new(container.Hook)
+						}
+						hook.Scripts = append(hook.Scripts, string(hookAndCommand[1]))
+						projSettings.ContainerHooks[hookName] = hook
+					}
 				}
 			}
 			continue
@@ -128,8 +183,11 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 				Placement: len(cmdsMap),
 				Hooks:     make(map[string]*container.Hook, 0),
 				Scale:     1,
+				ScaleSource: container.ScaleFromDefault,
+				CanaryCount: 1,
 				BlueGreenMode: container.BGModeUnknown,
 				Enabled: true,
+				HookInherit: true,
 			}
 		}
 
@@ -159,6 +217,77 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 					scale = 1
 				}
 				setting.Scale = scale
+				setting.ScaleSource = container.ScaleFromConfig
+			}
+		case "autoscale":
+			argParts := strings.Fields(args)
+			if len(argParts) != 3 {
+				return projSettings, errors.New(fmt.Sprintf("Failed to parse `autoscale` on line %d, expected min max cpu-target", lineNum+1))
+			}
+			var (
+				policy = new(container.AutoscalePolicy)
+				minErr, maxErr, cpuErr error
+			)
+			policy.Min, minErr = strconv.Atoi(argParts[0])
+			policy.Max, maxErr = strconv.Atoi(argParts[1])
+			policy.CPUTarget, cpuErr = strconv.ParseFloat(strings.TrimSuffix(argParts[2], "%"), 64)
+			if minErr != nil || maxErr != nil || cpuErr != nil || policy.Min < 1 || policy.Max < policy.Min || policy.CPUTarget <= 0 {
+				return projSettings, errors.New(fmt.Sprintf("Failed to parse `autoscale` on line %d, %s", lineNum+1, args))
+			}
+			setting.Autoscale = policy
+		case "update-parallelism":
+			if len(args) > 0 {
+				parallelism, err := strconv.Atoi(args)
+				if err != nil || parallelism < 0 {
+					return projSettings, errors.New(fmt.Sprintf("Failed to parse `update-parallelism` on line %d, %s", lineNum+1, args))
+				}
+				setting.UpdateParallelism = parallelism
+			}
+		case "update-delay":
+			if len(args) > 0 {
+				delay, err := time.ParseDuration(args)
+				if err != nil {
+					return projSettings, errors.New(fmt.Sprintf("Failed to parse `update-delay` on line %d, %s", lineNum+1, err))
+				}
+				setting.UpdateDelay = delay
+			}
+		case "update-timeout":
+			if len(args) > 0 {
+				timeout, err := time.ParseDuration(args)
+				if err != nil || timeout <= 0 {
+					return projSettings, errors.New(fmt.Sprintf("Failed to parse `update-timeout` on line %d, %s", lineNum+1, args))
+				}
+				setting.UpdateTimeout = timeout
+			}
+		case "update-order":
+			switch order := container.UpdateOrder(args); order {
+			case container.UpdateStartFirst, container.UpdateStopFirst:
+				setting.UpdateOrder = order
+			default:
+				return projSettings, errors.New(fmt.Sprintf("Failed to parse `update-order` on line %d, must be start-first or stop-first", lineNum+1))
+			}
+		case "strategy":
+			switch strategy := container.DeployStrategy(args); strategy {
+			case container.StrategyCanary:
+				setting.Strategy = strategy
+			default:
+				return projSettings, errors.New(fmt.Sprintf("Failed to parse `strategy` on line %d, unknown strategy %s", lineNum+1, args))
+			}
+		case "canary-count":
+			if len(args) > 0 {
+				count, err := strconv.Atoi(args)
+				if err != nil || count < 1 {
+					return projSettings, errors.New(fmt.Sprintf("Failed to parse `canary-count` on line %d, %s", lineNum+1, args))
+				}
+				setting.CanaryCount = count
+			}
+		case "bg-keep":
+			if len(args) > 0 {
+				keep, err := time.ParseDuration(args)
+				if err != nil {
+					return projSettings, errors.New(fmt.Sprintf("Failed to parse `bg-keep` on line %d, %s", lineNum+1, err))
+				}
+				setting.BGKeep = keep
 			}
 		case "image":
 			if len(args) > 0 {
@@ -188,6 +317,29 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 
 			setting.Links = append(setting.Links, newLink)
 
+		case "network":
+			argParts := strings.Fields(args)
+			if len(argParts) > 0 {
+				network := container.NetworkAttachment{
+					Name: argParts[0],
+				}
+				if len(argParts) > 1 {
+					network.Alias = argParts[1]
+				}
+				setting.Networks = append(setting.Networks, network)
+			}
+		case "instance-volume":
+			argParts := strings.SplitN(args, ":", 2)
+			if len(argParts) < 2 {
+				return projSettings, errors.New(fmt.Sprintf("Failed to parse `instance-volume` on line %d, expected name-template:path", lineNum+1))
+			}
+			if _, err := template.New("instanceVolume").Parse(argParts[0]); err != nil {
+				return projSettings, errors.New(fmt.Sprintf("Failed to parse `instance-volume` on line %d, %s", lineNum+1, err))
+			}
+			setting.InstanceVolumes = append(setting.InstanceVolumes, container.InstanceVolume{
+				Template: argParts[0],
+				Mount:    argParts[1],
+			})
 		case "rm":
 			setting.Remove = true
 		case "hook":
@@ -207,6 +359,18 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 				}
 				setting.Hooks = curHooks
 			}
+		case "hook-options":
+			optionArgs := strings.Fields(args)
+			if len(optionArgs) > 0 {
+				hook := setting.Hooks[optionArgs[0]]
+				if hook == nil {
+					hook = new(container.Hook)
+				}
+				if err := container.ParseHookOptions(optionArgs[1:], &hook.Options, false); err != nil {
+					return projSettings, errors.New(fmt.Sprintf("Failed to parse `hook-options` on line %d, %s", lineNum+1, err))
+				}
+				setting.Hooks[optionArgs[0]] = hook
+			}
 		case "blue-green":
 			if len(args) > 0 {
 				isBGMode, _ := strconv.ParseBool(args)
@@ -220,6 +384,10 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 			if len(args) > 0 {
 				setting.Enabled, _ = strconv.ParseBool(args)
 			}
+		case "hook-inherit":
+			if len(args) > 0 {
+				setting.HookInherit, _ = strconv.ParseBool(args)
+			}
 		case "volumes-from":
 			argParts := strings.SplitN(args, " ", 2)
 			setting.VolumesFrom = append(setting.VolumesFrom, argParts[0])
@@ -236,22 +404,51 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 		cmdsMap[contr] = setting
 	}
 
-	var containersState map[string]*helpers.ServiceState
-	if containersState, err = helpers.GetProjectState(projSettings.ProjectName, projSettings.ProjectSeparator); err != nil {
+	// resolve @name references to hook-defs
+	for hookName, hook := range projSettings.Hooks {
+		if hook.Scripts, err = resolveHookDefs(projSettings.HookDefs, hook.Scripts); err != nil {
+			err = errors.New("Failed to resolve global hook " + hookName + ", " + err.Error())
+			return
+		}
+	}
+	for hookName, hook := range projSettings.ContainerHooks {
+		if hook.Scripts, err = resolveHookDefs(projSettings.HookDefs, hook.Scripts); err != nil {
+			err = errors.New("Failed to resolve global container-hook " + hookName + ", " + err.Error())
+			return
+		}
+	}
+	for name, setting := range cmdsMap {
+		for hookName, hook := range setting.Hooks {
+			if hook.Scripts, err = resolveHookDefs(projSettings.HookDefs, hook.Scripts); err != nil {
+				err = errors.New("Failed to resolve " + name + " hook " + hookName + ", " + err.Error())
+				return
+			}
+		}
+	}
+
+	var projectContainers []*helpers.ServiceState
+	if projectContainers, err = helpers.GetProjectContainers(projSettings.ProjectName, projSettings.ProjectSeparator); err != nil {
+		return
+	}
+	if projSettings.State, err = loadProjectState(f.StateFile, projSettings.ProjectName); err != nil {
 		return
 	}
+
+	projSettings.ContainersState = projectContainers
 	// Post process
-	err = f.postProcessConfig(cmdsMap, projSettings, containersState)
+	err = f.postProcessConfig(cmdsMap, projSettings, projectContainers)
 	return
 
 }
 
 // Now that we have all settings do some house keeping and processing
-func (f *ConfigParser) postProcessConfig(parsedConfig map[string]container.Container, projSettings *ProjectConfig, state map[string]*helpers.ServiceState) error {
+func (f *ConfigParser) postProcessConfig(parsedConfig map[string]container.Container, projSettings *ProjectConfig, projectContainers []*helpers.ServiceState) error {
 
 	// TODO duplicate containers for scaling
 	projSettings.ContainerList = make(SettingsList, 0)
 
+	state := helpers.CurrentInstances(projectContainers, projSettings.ProjectSeparator)
+
 	for name, item := range parsedConfig {
 		if f.Filter != "" && f.Filter != name {
 			continue
@@ -273,7 +470,9 @@ func (f *ConfigParser) postProcessConfig(parsedConfig map[string]container.Conta
 
 		f.processBlueGreenMode(projSettings.BlueGreenMode, &item)
 
-		f.processScaleArg(&item)
+		f.processContainerHooks(projSettings.ContainerHooks, &item)
+
+		f.processScaleArg(projSettings.State, &item)
 
 		f.processCleanupTasks(projSettings, &item)
 
@@ -284,11 +483,20 @@ func (f *ConfigParser) postProcessConfig(parsedConfig map[string]container.Conta
 		f.processVolumesFrom(parsedConfig, &item)
 
 		ctrsToAdd := f.scaleContainers(&item, state)
+		for _, ctr := range ctrsToAdd {
+			if err := ctr.RenderInstanceVolumes(); err != nil {
+				return errors.New("Failed to render instance volume for " + ctr.Name + ": " + err.Error())
+			}
+		}
+
+		f.processKeptColors(projSettings, &item, projectContainers, state)
 
 
 		projSettings.ContainerList = append(projSettings.ContainerList, ctrsToAdd...)
 	}
 
+	f.processOrphans(parsedConfig, projSettings, projectContainers)
+
 
 	return nil
 }
@@ -305,6 +513,51 @@ func (f *ConfigParser) processBlueGreenMode(globalBGMode bool, item *container.C
 
 }
 
+// Replace hook scripts of the form `@name args` with the body of the named
+// hook-def, with the args as its positional parameters
+func resolveHookDefs(defs map[string]string, scripts []string) ([]string, error) {
+	resolved := make([]string, len(scripts))
+	for i, script := range scripts {
+		resolved[i] = script
+		if !strings.HasPrefix(script, hookDefPrefix) {
+			continue
+		}
+		nameAndArgs := strings.SplitN(strings.TrimPrefix(script, hookDefPrefix), " ", 2)
+		body, found := defs[nameAndArgs[0]]
+		if !found {
+			return nil, errors.New("unknown hook-def " + nameAndArgs[0])
+		}
+		setArgs := "set --"
+		if len(nameAndArgs) > 1 {
+			setArgs += " " + nameAndArgs[1]
+		}
+		if strings.HasPrefix(body, container.ExecHookPrefix) {
+			// keep running it in the container
+			resolved[i] = container.ExecHookPrefix + " " + setArgs + "\n" + strings.TrimSpace(strings.TrimPrefix(body, container.ExecHookPrefix))
+		} else {
+			resolved[i] = setArgs + "\n" + body
+		}
+	}
+	return resolved, nil
+}
+
+// Add the global container hooks to the container's own, running after them,
+// unless it opted out with hook-inherit false
+func (f *ConfigParser) processContainerHooks(globalHooks container.Hooks, item *container.Container) {
+	if !item.HookInherit {
+		return
+	}
+	for hookName, globalHook := range globalHooks {
+		hook := &container.Hook{}
+		if own, found := item.Hooks[hookName]; found {
+			hook.Options = own.Options
+			hook.Scripts = append(hook.Scripts, own.Scripts...)
+		}
+		hook.Scripts = append(hook.Scripts, globalHook.Scripts...)
+		item.Hooks[hookName] = hook
+	}
+}
+
 // Parse the volumes-from args and try and find first container with that type
 func (f *ConfigParser) processVolumesFrom(parsedConfig map[string]container.Container, item *container.Container) {
 	for i, ctrName := range item.VolumesFrom {
@@ -329,35 +582,89 @@ func (f *ConfigParser) processLinks(parsedConfig map[string]container.Container,
 	}
 }
 
-// Parse the scale argument and set the container's scale property
-func (f *ConfigParser) processScaleArg(ctr *container.Container) {
-	if f.Args.Get(0) == "scale" {
+// Work out the container's scale property. The config is overridden by any
+// scale recorded by an earlier `scale` command, which is overridden by the
+// argument to the current `scale` command.
+func (f *ConfigParser) processScaleArg(state *ProjectState, ctr *container.Container) {
+	isScaleCmd := f.Args.Get(0) == "scale"
+	reset := isScaleCmd && f.Args.Get(1) == "--reset" && f.Args.Get(2) == ctr.ServiceType
+
+	if override, found := state.Scale[ctr.ServiceType]; found && override > 0 && !reset {
+		ctr.Scale = override
+		ctr.ScaleSource = container.ScaleFromOverride
+	}
+
+	if isScaleCmd {
 		if f.Args.Get(1) == ctr.ServiceType {
 			if scaleArg, err := strconv.Atoi(f.Args.Get(2)); err == nil {
 				if scaleArg > 0 {
 					ctr.Scale = scaleArg
+					ctr.ScaleSource = container.ScaleFromCommand
 				}
 			}
 		}
 	}
 }
 
-// Create list of containers to cleanup when scaling
+// Create list of containers to cleanup when scaling, every colour of any
+// instance above the service's scale
 func (f *ConfigParser) processCleanupTasks(projSettings *ProjectConfig, ctr *container.Container) {
 	var tasks SettingsList
 	for _, existing := range projSettings.ContainersState {
-		instNum, err := helpers.GetNumericSuffix(existing.Name, ctr.ProjectNameSeparator)
-		if err != nil || instNum < 0 || instNum > ctr.Scale {
-			tempCtr := new(container.Container)
-			*tempCtr = *ctr
-			tempCtr.Name = existing.Name
-			tasks = append(tasks, tempCtr)
+		if existing.ServiceName != ctr.Name || existing.InstanceNum <= ctr.Scale {
+			continue
 		}
+		tempCtr := new(container.Container)
+		*tempCtr = *ctr
+		tempCtr.Name = existing.Name
+		tempCtr.InstanceNumber = existing.InstanceNum
+		tempCtr.State = existing
+		tasks = append(tasks, tempCtr)
 	}
 	projSettings.ContainerCleanupList = append(projSettings.ContainerCleanupList, tasks...)
 	return
 }
 
+// Find project containers whose service is no longer in the config
+func (f *ConfigParser) processOrphans(parsedConfig map[string]container.Container, projSettings *ProjectConfig, projectContainers []*helpers.ServiceState) {
+	// with a filter other services are out of scope rather than orphaned
+	if f.Filter != "" {
+		return
+	}
+	for _, existing := range projectContainers {
+		if _, found := parsedConfig[existing.ServiceType]; found {
+			continue
+		}
+		projSettings.OrphanList = append(projSettings.OrphanList, projSettings.containerFromState(nil, existing))
+	}
+}
+
+// Add old colours kept after a blue/green handover to the cleanup list once
+// their bg-keep grace period has passed
+func (f *ConfigParser) processKeptColors(projSettings *ProjectConfig, ctr *container.Container, projectContainers []*helpers.ServiceState, state map[string]*helpers.ServiceState) {
+	for _, existing := range projectContainers {
+		if existing.ServiceName != ctr.Name || existing.Running || existing.InstanceNum > ctr.Scale {
+			continue
+		}
+		current := state[existing.ServiceName+ctr.ProjectNameSeparator+strconv.Itoa(existing.InstanceNum)]
+		if current == nil || current.ID == existing.ID {
+			continue
+		}
+		if ctr.BGKeep > 0 {
+			if finishedAt, err := helpers.ContainerFinishedAt(existing.Name); err != nil || time.Since(finishedAt) < ctr.BGKeep {
+				continue
+			}
+		}
+
+		tempCtr := new(container.Container)
+		*tempCtr = *ctr
+		tempCtr.Name = existing.Name
+		tempCtr.InstanceNumber = existing.InstanceNum
+		tempCtr.State = existing
+		projSettings.ContainerCleanupList = append(projSettings.ContainerCleanupList, tempCtr)
+	}
+}
+
 // Create copies of containers which need to scale
 func (f *ConfigParser) scaleContainers(ctr *container.Container, state map[string]*helpers.ServiceState) []*container.Container {
 
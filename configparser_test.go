@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	"strings"
+	"testing"
+)
+
+func TestGlobalHookOptionsRejectRollback(t *testing.T) {
+	_, restore := fakeDocker(t, "", `global project demo
+global hook before.up ./check.sh
+global hook-options before.up on-failure=rollback
+app image nginx`)
+	defer restore()
+
+	_, err := loadSettings(nil)
+	if err == nil || !strings.Contains(err.Error(), "rollback") {
+		t.Fatalf("expected a rollback error, got %v", err)
+	}
+}
+
+func TestHookOptionsAllowRollback(t *testing.T) {
+	_, restore := fakeDocker(t, "", `global project demo
+app image nginx
+app hook after.run ./check.sh
+app hook-options after.run retries=2 on-failure=rollback`)
+	defer restore()
+
+	settings, err := loadSettings(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := settings.ContainerList[0].Hooks["after.run"].Options
+	if opts.OnFailure != container.HookRollback || opts.Retries != 2 {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+}
@@ -1,6 +1,7 @@
 package container
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	. "github.com/byrnedo/capitan/consts"
@@ -8,11 +9,14 @@ import (
 	"github.com/byrnedo/capitan/logger"
 	. "github.com/byrnedo/capitan/logger"
 	"github.com/codeskyblue/go-sh"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 "strconv"
 	"github.com/byrnedo/capitan/shellsession"
@@ -48,6 +52,22 @@ type Link struct {
 	Alias     string
 }
 
+// A network the container joins, with an optional alias on that network
+type NetworkAttachment struct {
+	Name  string
+	Alias string
+}
+
+// A volume created for a single instance, named from a template
+type InstanceVolume struct {
+	// text/template for the volume name, executed against the container
+	Template string
+	// the rendered volume name
+	Name string
+	// where to mount it, with optional mode, eg /data:ro
+	Mount string
+}
+
 type AppliedAction string
 
 const (
@@ -62,11 +82,33 @@ const (
 type Hook struct {
 	Scripts []string
 	Ses     *shellsession.ShellSession
+	Options HookOptions
 }
 
 type Hooks map[string]*Hook
 
 
+// Hook scripts starting with this are run inside the container
+const ExecHookPrefix = "exec:"
+
+// Arguments to `docker exec` to run a hook script in the container with
+// sh, passing on the session's CAPITAN_* environment
+func execHookArgs(ctr *Container, ses *shellsession.ShellSession, script string) []interface{} {
+	keys := make([]string, 0, len(ses.Env))
+	for key := range ses.Env {
+		if strings.HasPrefix(key, "CAPITAN_") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	args := []interface{}{"exec"}
+	for _, key := range keys {
+		args = append(args, "-e", key+"="+ses.Env[key])
+	}
+	return append(args, ctr.Name, "sh", "-c", strings.TrimSpace(script))
+}
+
 func NewContainerShellSession(ctr *Container) *shellsession.ShellSession {
 	return shellsession.NewShellSession(func(s *shellsession.ShellSession){
 		s.SetEnv("CAPITAN_CONTAINER_NAME", ctr.Name)
@@ -76,8 +118,74 @@ func NewContainerShellSession(ctr *Container) *shellsession.ShellSession {
 	})
 }
 
+// Environment for container hooks describing the container as it is now,
+// values docker doesn't know yet, eg before.run, are left empty
+func hookEnv(ctr *Container) map[string]string {
+	env := map[string]string{
+		"CAPITAN_CONTAINER_IMAGE":  ctr.Image,
+		"CAPITAN_CONTAINER_ACTION": string(ctr.Action),
+	}
+	if ctr.State != nil {
+		env["CAPITAN_DEPLOY_COLOR"] = ctr.State.Color
+		if ctr.PreviousColor != "" {
+			env["CAPITAN_PREVIOUS_COLOR"] = ctr.PreviousColor
+			env["CAPITAN_NEW_COLOR"] = ctr.State.Color
+		}
+	}
+
+	details, err := helpers.InspectContainer(ctr.Name)
+	if err != nil {
+		return env
+	}
+	env["CAPITAN_CONTAINER_ID"] = details.ID
+	env["CAPITAN_CONTAINER_IMAGE_ID"] = details.ImageID
+
+	networks := make([]string, 0, len(details.IPs))
+	for network, ip := range details.IPs {
+		env["CAPITAN_CONTAINER_IP_"+envName(network)] = ip
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	// the ip on the network given to docker run, else the first one
+	if len(ctr.Networks) > 0 && details.IPs[ctr.Networks[0].Name] != "" {
+		env["CAPITAN_CONTAINER_IP"] = details.IPs[ctr.Networks[0].Name]
+	} else if len(networks) > 0 {
+		env["CAPITAN_CONTAINER_IP"] = details.IPs[networks[0]]
+	}
+
+	var ports []string
+	for port, bindings := range details.Ports {
+		for i, binding := range bindings {
+			if i == 0 {
+				env["CAPITAN_CONTAINER_PORT_"+envName(port)] = binding.HostPort
+			}
+			ports = append(ports, port+"->"+binding.HostIp+":"+binding.HostPort)
+		}
+	}
+	sort.Strings(ports)
+	env["CAPITAN_CONTAINER_PORTS"] = strings.Join(ports, " ")
+	return env
+}
+
+// Upper case a name for use in an environment variable, eg 80/tcp becomes 80_TCP
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+}
+
 // Runs a hook command if it exists for a specific container
 func (h Hooks) Run(hookName string, ctr *Container) error {
+	return h.RunWithEnv(hookName, ctr, nil, os.Stdout)
+}
+
+// Runs a hook command if it exists for a specific container, with extra
+// environment variables on top of the usual CAPITAN_* ones. The hook's
+// stdout is written to out.
+func (h Hooks) RunWithEnv(hookName string, ctr *Container, env map[string]string, out io.Writer) error {
 	var (
 		hook  *Hook
 		found bool
@@ -89,16 +197,29 @@ func (h Hooks) Run(hookName string, ctr *Container) error {
 	}
 
 	for _, script := range hook.Scripts {
-		hook.Ses = NewContainerShellSession(ctr)
-		hook.Ses.SetEnv("CAPITAN_HOOK_NAME", hookName)
-
-		hook.Ses.Command("bash", "-c", script)
+		err = hook.Options.RunScript(hookName, func() *shellsession.ShellSession {
+			hook.Ses = NewContainerShellSession(ctr)
+			hook.Ses.SetEnv("CAPITAN_HOOK_NAME", hookName)
+			for key, val := range hookEnv(ctr) {
+				hook.Ses.SetEnv(key, val)
+			}
+			for key, val := range env {
+				hook.Ses.SetEnv(key, val)
+			}
 
-		hook.Ses.Stdout = os.Stdout
-		hook.Ses.Stderr = os.Stderr
-		hook.Ses.Stdin = os.Stdin
+			if strings.HasPrefix(script, ExecHookPrefix) {
+				hook.Ses.Command("docker", execHookArgs(ctr, hook.Ses, strings.TrimPrefix(script, ExecHookPrefix))...)
+			} else {
+				hook.Ses.Command("bash", "-c", script)
+				hook.Ses.Stdin = os.Stdin
+			}
 
-		if err = hook.Ses.Run(); err != nil {
+			color := nextColor()
+			hook.Ses.Stdout = NewHookLogWriter(out, ctr.Name, hookName, color)
+			hook.Ses.Stderr = NewHookLogWriter(os.Stderr, ctr.Name, hookName, color)
+			return hook.Ses
+		})
+		if err != nil {
 			return err
 		}
 	}
@@ -113,6 +234,47 @@ const (
 	BGModeUnknown
 )
 
+type UpdateOrder string
+
+const (
+	// start-first when blue/green mode is on, otherwise stop-first
+	UpdateOrderDefault UpdateOrder = ""
+	// start the new instance before removing the old one
+	UpdateStartFirst UpdateOrder = "start-first"
+	// remove the old instance before starting the new one
+	UpdateStopFirst UpdateOrder = "stop-first"
+)
+
+type DeployStrategy string
+
+const (
+	// replace instances as they are reached, or in batches with update-parallelism
+	StrategyDefault DeployStrategy = ""
+	// deploy to canary-count instances and verify them before the rest
+	StrategyCanary DeployStrategy = "canary"
+)
+
+type ScaleSource string
+
+const (
+	// no scale given, defaults to 1
+	ScaleFromDefault ScaleSource = "default"
+	// the `scale` option in the config
+	ScaleFromConfig ScaleSource = "config"
+	// recorded by an earlier `scale` command
+	ScaleFromOverride ScaleSource = "override"
+	// the argument to the current `scale` command
+	ScaleFromCommand ScaleSource = "command"
+)
+
+// Bounds and target for the autoscale command
+type AutoscalePolicy struct {
+	Min int
+	Max int
+	// target cpu percentage per instance
+	CPUTarget float64
+}
+
 type Container struct {
 	// Container name
 	Name string
@@ -134,14 +296,24 @@ type Container struct {
 	Command []string
 	// links
 	Links []Link
+	// networks to join, the first is given to docker run
+	Networks []NetworkAttachment
 	// volumes from list
 	VolumesFrom []string
+	// volumes created per instance
+	InstanceVolumes []InstanceVolume
 	// hooks map for this definition
 	Hooks Hooks
+	// whether the global container hooks are added to Hooks
+	HookInherit bool
 	// used in commands
 	Action AppliedAction
 	// the total number of containers to scale to.
 	Scale int
+	// where the scale came from
+	ScaleSource ScaleSource
+	// scale limits used by the autoscale command, nil if not autoscaled
+	Autoscale *AutoscalePolicy
 	// the arguments for docker run / create
 	RunArguments []interface{}
 	// the project name
@@ -158,6 +330,30 @@ type Container struct {
 	Enabled bool
 	// The current state of the container
 	State *helpers.ServiceState
+	// How many instances to replace at once when run arguments change, 0 replaces each as it is reached
+	UpdateParallelism int
+	// Pause between batches of a rolling update
+	UpdateDelay time.Duration
+	// How long each batch of a rolling or canary update may take to become ready, 0 uses the wait timeout
+	UpdateTimeout time.Duration
+	// Whether new instances are started before or after old ones are removed in a rolling update
+	UpdateOrder UpdateOrder
+	// How changed run arguments are rolled out
+	Strategy DeployStrategy
+	// Number of instances to deploy first with the canary strategy
+	CanaryCount int
+	// How long to keep the old colour stopped after a blue/green handover, 0 removes it straight away
+	BGKeep time.Duration
+	// The colour being replaced during a blue/green deploy or rollback
+	PreviousColor string
+}
+
+// Whether a rolling update starts new instances before removing old ones
+func (set *Container) UpdateStartsFirst() bool {
+	if set.UpdateOrder == UpdateOrderDefault {
+		return set.BlueGreenMode == BGModeOn
+	}
+	return set.UpdateOrder == UpdateStartFirst
 }
 
 func (set *Container) NewName() {
@@ -174,7 +370,7 @@ func (set *Container) BuildImage() error {
 		"build",
 	}, helpers.ToInterfaceSlice(set.BuildArgs)...)
 
-	args = append(args, "--tag", set.Image, set.Build)
+	args = append(args, "--label", ProjectLabelName+"="+set.ProjectName, "--tag", set.Image, set.Build)
 
 	if _, err := helpers.RunCmd(args...); err != nil {
 		return err
@@ -273,7 +469,10 @@ func (set *Container) BlueGreenCopy() (newCon *Container) {
 
 	newCon = new(Container)
 	*newCon = *set
+	newState := *set.State
+	newCon.State = &newState
 	newCon.State.Color = newColor
+	newCon.PreviousColor = set.State.Color
 	newCon.NewName()
 	return
 
@@ -284,6 +483,10 @@ func (set *Container) BlueGreenDeploy(attach bool, dryRun bool, wg *sync.WaitGro
 
 	newCon := set.BlueGreenCopy()
 
+	if err := newCon.RemoveKeptColor(dryRun); err != nil {
+		return err
+	}
+
 	if err := newCon.Run(attach, dryRun, wg); err != nil {
 		// put back the old
 		Warning.Println("Error running new container, killing...")
@@ -291,6 +494,47 @@ func (set *Container) BlueGreenDeploy(attach bool, dryRun bool, wg *sync.WaitGro
 		return  err
 	}
 
+	return set.HandOver(newCon, dryRun)
+}
+
+// Remove an old container kept with bg-keep that is occupying the name of
+// the colour about to be deployed
+func (set *Container) RemoveKeptColor(dryRun bool) error {
+	if !helpers.ContainerExists(set.Name) {
+		return nil
+	}
+	ContainerInfoLog(set.Name, "Removing previously kept container...")
+	if dryRun {
+		return nil
+	}
+	return set.Rm([]string{"-f"})
+}
+
+// Hand over from this container to its new colour once the new one is running.
+//
+// Runs the new container's switch hook, so traffic can be repointed, then
+// removes this container. If bg-keep is set it is only stopped, and is
+// removed by a later command once the grace period has passed.
+func (set *Container) HandOver(newCon *Container, dryRun bool) error {
+	if !dryRun {
+		if err := newCon.Hooks.Run("switch", newCon); err != nil {
+			Warning.Println("Switch hook failed, removing new container...")
+			newCon.Rm([]string{"-f"})
+			return err
+		}
+	}
+
+	if set.BGKeep > 0 {
+		ContainerInfoLog(newCon.Name, "Stopping old container "+set.Name+", keeping it for "+set.BGKeep.String()+"...")
+		if !dryRun && set.State.Running {
+			if err := set.Stop(nil); err != nil {
+				Error.Println("Error stopping old container")
+				return err
+			}
+		}
+		return nil
+	}
+
 	// shutdown the old
 	ContainerInfoLog(newCon.Name, "Removing old container "+set.Name+"...")
 	if ! dryRun {
@@ -303,6 +547,17 @@ func (set *Container) BlueGreenDeploy(attach bool, dryRun bool, wg *sync.WaitGro
 	return nil
 }
 
+// Replace the container after its run arguments changed, using a
+// blue/green handover if enabled
+func (set *Container) Redeploy(attach bool, dryRun bool, wg *sync.WaitGroup) error {
+	if set.BlueGreenMode == BGModeOn {
+		ContainerInfoLog(set.Name, "Run arguments changed, doing blue-green redeploy...")
+		return set.BlueGreenDeploy(attach, dryRun, wg)
+	}
+	ContainerInfoLog(set.Name, "Removing (run arguments changed)")
+	return set.RecreateAndRun(attach, dryRun, wg)
+}
+
 func (set *Container) RecreateAndRun(attach bool, dryRun bool, wg *sync.WaitGroup) error {
 	if !dryRun {
 		set.Rm([]string{"-f"})
@@ -314,10 +569,19 @@ func (set *Container) RecreateAndRun(attach bool, dryRun bool, wg *sync.WaitGrou
 	return nil
 }
 
-func createCapitanContainerLabels(ctr *Container, args []interface{}) []interface{} {
+// Hash of everything that requires the container to be recreated when it changes
+func (set *Container) RunArgumentsHash() string {
+	args := set.GetRunArguments()
+	for _, network := range set.extraNetworks() {
+		args = append(args, "network:"+network.Name+":"+network.Alias)
+	}
+	return helpers.HashInterfaceSlice(args)
+}
+
+func createCapitanContainerLabels(ctr *Container) []interface{} {
 	return []interface{}{
 		"--label",
-		UniqueLabelName + "=" + helpers.HashInterfaceSlice(args),
+		UniqueLabelName + "=" + ctr.RunArgumentsHash(),
 		"--label",
 		ServiceLabelName + "=" + ctr.ServiceName,
 		"--label",
@@ -342,15 +606,21 @@ func (set *Container) Create(dryRun bool) error {
 	if err := set.Hooks.Run("before.create", set); err != nil {
 		return err
 	}
+	if err := set.createInstanceVolumes(); err != nil {
+		return err
+	}
 
 	cmd := set.GetRunArguments()
-	labels := createCapitanContainerLabels(set, cmd)
+	labels := createCapitanContainerLabels(set)
 	cmd = append(labels, cmd...)
 
 	cmd = append([]interface{}{"create"}, cmd...)
 	if err := set.launchDaemonCommand(cmd); err != nil {
 		return err
 	}
+	if err := set.connectExtraNetworks(); err != nil {
+		return err
+	}
 
 	return set.Hooks.Run("after.create", set)
 }
@@ -366,12 +636,18 @@ func (set *Container) Run(attach bool, dryRun bool, wg *sync.WaitGroup) error {
 	if err := set.Hooks.Run("before.run", set); err != nil {
 		return err
 	}
+	if err := set.createInstanceVolumes(); err != nil {
+		return err
+	}
 
 	cmd := set.GetRunArguments()
-	labels := createCapitanContainerLabels(set, cmd)
+	labels := createCapitanContainerLabels(set)
 	cmd = append(labels, cmd...)
 
 	if set.Remove {
+		if len(set.extraNetworks()) > 0 {
+			Warning.Println("Only the first network is joined when running with rm:", set.Name)
+		}
 		if err := set.launchWithRmInForeground(cmd); err != nil {
 			return err
 		}
@@ -379,14 +655,29 @@ func (set *Container) Run(attach bool, dryRun bool, wg *sync.WaitGroup) error {
 		if err := set.launchInForeground(cmd, wg); err != nil {
 			return err
 		}
+		if err := set.connectExtraNetworks(); err != nil {
+			return err
+		}
 	} else {
 		cmd = append([]interface{}{"run", "-d"}, cmd...)
 		if err := set.launchDaemonCommand(cmd); err != nil {
 			return err
 		}
+		if err := set.connectExtraNetworks(); err != nil {
+			return err
+		}
 	}
 
-	return set.Hooks.Run("after.run", set)
+	if err := set.Hooks.Run("after.run", set); err != nil {
+		// only undo the run when the colour it replaces is still there to
+		// fall back to, otherwise this is the instance's only container
+		if IsHookRollback(err) && !set.Remove && set.PreviousColor != "" {
+			Warning.Println("after.run hook failed, removing " + set.Name + "...")
+			set.Rm([]string{"-f"})
+		}
+		return err
+	}
+	return nil
 }
 
 func (set *Container) launchDaemonCommand(cmd []interface{}) error {
@@ -424,6 +715,62 @@ func (set *Container) startLoggedCommand(cmd []interface{}) (*shellsession.Shell
 	return ses, err
 }
 
+// Render the names of the instance volumes for this container
+func (set *Container) RenderInstanceVolumes() error {
+	rendered := make([]InstanceVolume, len(set.InstanceVolumes))
+	for i, vol := range set.InstanceVolumes {
+		tmpl, err := template.New("instanceVolume").Parse(vol.Template)
+		if err != nil {
+			return err
+		}
+		var name bytes.Buffer
+		if err = tmpl.Execute(&name, set); err != nil {
+			return err
+		}
+		vol.Name = name.String()
+		rendered[i] = vol
+	}
+	set.InstanceVolumes = rendered
+	return nil
+}
+
+// Create any instance volumes that don't exist yet, labelled with the project name
+func (set *Container) createInstanceVolumes() error {
+	for _, vol := range set.InstanceVolumes {
+		if helpers.VolumeExists(vol.Name) {
+			continue
+		}
+		ContainerInfoLog(set.Name, "Creating volume "+vol.Name+"...")
+		if err := helpers.CreateVolume(vol.Name, set.ProjectName, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Networks joined after the container is created, docker run only takes one
+func (set *Container) extraNetworks() []NetworkAttachment {
+	if len(set.Networks) < 2 {
+		return nil
+	}
+	return set.Networks[1:]
+}
+
+// Connect the container to every network after the first
+func (set *Container) connectExtraNetworks() error {
+	for _, network := range set.extraNetworks() {
+		args := []interface{}{"network", "connect"}
+		if network.Alias != "" {
+			args = append(args, "--alias", network.Alias)
+		}
+		args = append(args, network.Name, set.Name)
+		if _, err := helpers.RunCmd(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Create docker arg slice from container options
 func (set *Container) GetRunArguments() []interface{} {
 	imageName := set.Name
@@ -445,7 +792,22 @@ func (set *Container) GetRunArguments() []interface{} {
 		volumesFromArgs = append(volumesFromArgs, "--volumes-from", vol)
 	}
 
+	var networkArgs = make([]interface{}, 0, 4)
+	if len(set.Networks) > 0 {
+		networkArgs = append(networkArgs, "--net", set.Networks[0].Name)
+		if set.Networks[0].Alias != "" {
+			networkArgs = append(networkArgs, "--net-alias", set.Networks[0].Alias)
+		}
+	}
+
+	var instanceVolumeArgs = make([]interface{}, 0, len(set.InstanceVolumes)*2)
+	for _, vol := range set.InstanceVolumes {
+		instanceVolumeArgs = append(instanceVolumeArgs, "--volume", vol.Name+":"+vol.Mount)
+	}
+
 	cmd := append([]interface{}{"--name", set.Name}, helpers.ToInterfaceSlice(set.ContainerArgs)...)
+	cmd = append(cmd, networkArgs...)
+	cmd = append(cmd, instanceVolumeArgs...)
 	cmd = append(cmd, linkArgs...)
 	cmd = append(cmd, volumesFromArgs...)
 	cmd = append(cmd, imageName)
@@ -536,16 +898,29 @@ func (set *Container) IPs() string {
 	return ip
 }
 
+// Arguments to `docker logs` to follow from a point in time, or the
+// last 10 lines if since is zero
+func logsArgs(name string, since time.Time, extra ...interface{}) []interface{} {
+	args := []interface{}{"logs", "-f"}
+	if since.IsZero() {
+		args = append(args, "--tail", "10")
+	} else {
+		args = append(args, "--since", since.Format(time.RFC3339Nano))
+	}
+	args = append(args, extra...)
+	return append(args, name)
+}
+
 // Start streaming a container's logs
 // TODO needs to respect scale
-func (set *Container) Logs() (*sh.Session, error) {
+func (set *Container) Logs(since time.Time) (*sh.Session, error) {
 	color := nextColor()
 	ses := sh.NewSession()
 
 	if logger.GetLevel() == DebugLevel {
 		ses.ShowCMD = true
 	}
-	ses.Command("docker", "logs", "--tail", "10", "-f", set.Name)
+	ses.Command("docker", logsArgs(set.Name, since)...)
 
 	ses.Stdout = NewContainerLogWriter(os.Stdout, set.Name, color)
 	ses.Stderr = NewContainerLogWriter(os.Stderr, set.Name, color)
@@ -554,6 +929,30 @@ func (set *Container) Logs() (*sh.Session, error) {
 	return ses, err
 }
 
+// Start streaming a container's logs with docker timestamps, sending each
+// line on the given channel
+func (set *Container) LogLines(lines chan<- *LogLine, since time.Time) (*sh.Session, error) {
+	color := nextColor()
+	ses := sh.NewSession()
+
+	if logger.GetLevel() == DebugLevel {
+		ses.ShowCMD = true
+	}
+	ses.Command("docker", logsArgs(set.Name, since, "-t")...)
+
+	source := LogSource{
+		Container:   set.Name,
+		ServiceType: set.ServiceType,
+		Instance:    set.InstanceNumber,
+		Color:       set.State.Color,
+	}
+	ses.Stdout = NewLogLineWriter(lines, source, "stdout", NewContainerLogWriter(os.Stdout, set.Name, color))
+	ses.Stderr = NewLogLineWriter(lines, source, "stderr", NewContainerLogWriter(os.Stderr, set.Name, color))
+
+	err := ses.Start()
+	return ses, err
+}
+
 // Kills the container
 // TODO needs to respect scale
 func (set *Container) Kill(args []string) error {
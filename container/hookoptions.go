@@ -0,0 +1,129 @@
+package container
+
+import (
+	"errors"
+	. "github.com/byrnedo/capitan/logger"
+	"github.com/byrnedo/capitan/shellsession"
+	"github.com/codeskyblue/go-sh"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HookFailurePolicy string
+
+const (
+	// fail the command, the default
+	HookAbort HookFailurePolicy = "abort"
+	// log the failure and carry on
+	HookContinue HookFailurePolicy = "continue"
+	// fail the command and, if the container replaced a colour that is still
+	// running, remove it so the old colour keeps serving
+	HookRollback HookFailurePolicy = "rollback"
+)
+
+// How a hook's scripts are run, set with `hook-options`
+type HookOptions struct {
+	// kill a script that runs longer than this, 0 for no limit
+	Timeout time.Duration
+	// times to run a failed script again
+	Retries int
+	// pause before each retry
+	RetryDelay time.Duration
+	// what to do when a script still fails after its retries
+	OnFailure HookFailurePolicy
+}
+
+// A hook that failed after its retries
+type HookError struct {
+	Hook   string
+	Policy HookFailurePolicy
+	Err    error
+}
+
+func (e *HookError) Error() string {
+	return e.Hook + ": " + e.Err.Error()
+}
+
+// Whether an error is from a hook with the rollback failure policy
+func IsHookRollback(err error) bool {
+	hookErr, ok := err.(*HookError)
+	return ok && hookErr.Policy == HookRollback
+}
+
+// Parse `key=value` hook options, eg "timeout=30s retries=3 retry-delay=5s on-failure=continue",
+// on top of the given ones. Global hooks have no container to roll back, so
+// on-failure=rollback is rejected for them.
+func ParseHookOptions(args []string, opts *HookOptions, global bool) error {
+	for _, arg := range args {
+		keyVal := strings.SplitN(arg, "=", 2)
+		if len(keyVal) != 2 {
+			return errors.New("expected key=value, got " + arg)
+		}
+		var err error
+		switch keyVal[0] {
+		case "timeout":
+			opts.Timeout, err = time.ParseDuration(keyVal[1])
+		case "retries":
+			if opts.Retries, err = strconv.Atoi(keyVal[1]); err == nil && opts.Retries < 0 {
+				err = errors.New("retries must not be negative")
+			}
+		case "retry-delay":
+			opts.RetryDelay, err = time.ParseDuration(keyVal[1])
+		case "on-failure":
+			switch policy := HookFailurePolicy(keyVal[1]); policy {
+			case HookAbort, HookContinue:
+				opts.OnFailure = policy
+			case HookRollback:
+				if global {
+					err = errors.New("on-failure=rollback is only for container hooks")
+				} else {
+					opts.OnFailure = policy
+				}
+			default:
+				err = errors.New("on-failure must be abort, continue or rollback")
+			}
+		default:
+			err = errors.New("unknown option " + keyVal[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run a hook script, timing out and retrying as set in the options.
+// newSession is called to set up the session and its command for each attempt.
+//
+// If the script still fails the failure policy is applied: nil is returned
+// to continue, otherwise a *HookError.
+func (o HookOptions) RunScript(hookName string, newSession func() *shellsession.ShellSession) error {
+	var err error
+	for attempt := 0; attempt <= o.Retries; attempt++ {
+		if attempt > 0 {
+			Warning.Printf("Hook %s failed (%s), retrying %d/%d...\n", hookName, err, attempt, o.Retries)
+			time.Sleep(o.RetryDelay)
+		}
+		ses := newSession()
+		if o.Timeout > 0 {
+			ses.SetTimeout(o.Timeout)
+		}
+		if err = ses.Run(); err == nil {
+			return nil
+		}
+		if err == sh.ErrExecTimeout {
+			err = errors.New("timed out after " + o.Timeout.String())
+		}
+	}
+
+	if o.OnFailure == HookContinue {
+		Warning.Printf("Hook %s failed (%s), continuing\n", hookName, err)
+		return nil
+	}
+	return &HookError{
+		Hook:   hookName,
+		Policy: o.OnFailure,
+		Err:    err,
+	}
+}
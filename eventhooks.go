@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/consts"
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix of hooks run on docker events, eg on.die
+	eventHookPrefix = "on."
+	// wait before following docker events again after the stream exits
+	eventRetryInterval = 5 * time.Second
+)
+
+// Run the on.<action> hook of the service a container event is for, eg
+// on.die, on.oom or on.health_status.
+//
+// The hook gets the event as CAPITAN_EVENT_* environment variables, with
+// each attribute as CAPITAN_EVENT_ATTR_<NAME>, and the exit code of dies as
+// CAPITAN_EXIT_CODE.
+//
+// Capitan's log line and the hook's stdout are written to out, so callers
+// printing events as json can keep them off stdout.
+func (settings *ProjectConfig) RunEventHook(event *helpers.ContainerEvent, out io.Writer) {
+	if event.Type != "container" || event.ServiceType == "" {
+		return
+	}
+	hookName := eventHookPrefix + event.Action
+	set := settings.eventContainer(event)
+	if _, found := set.Hooks[hookName]; !found {
+		return
+	}
+
+	env := map[string]string{
+		"CAPITAN_EVENT_ACTION": event.Action,
+		"CAPITAN_EVENT_DETAIL": event.Detail,
+		"CAPITAN_EVENT_TIME":   event.Time.Format(time.RFC3339Nano),
+		// the container may be gone by the time the hook runs
+		"CAPITAN_CONTAINER_ID": event.ID,
+	}
+	for key, val := range event.Attributes {
+		env["CAPITAN_EVENT_ATTR_"+eventEnvName(key)] = val
+	}
+	if exitCode, found := event.Attributes["exitCode"]; found {
+		env["CAPITAN_EXIT_CODE"] = exitCode
+	}
+	if event.Action == "health_status" {
+		env["CAPITAN_HEALTH_STATUS"] = event.Detail
+	}
+
+	ContainerInfoLogTo(out, set.Name, "Running", hookName, "hook...")
+	if dryRun {
+		return
+	}
+	if err := set.Hooks.RunWithEnv(hookName, set, env, out); err != nil {
+		Error.Println("Hook", hookName, "failed for", set.Name+":", err)
+	}
+}
+
+// The configured container an event is for, or one made from the event's
+// labels if it's for a colour or instance not in the config
+func (settings *ProjectConfig) eventContainer(event *helpers.ContainerEvent) *container.Container {
+	for _, set := range settings.ContainerList {
+		if set.Name == event.Name {
+			return set
+		}
+	}
+	return settings.containerFromState(settings.ContainerList, &helpers.ServiceState{
+		ID:          event.ID,
+		Name:        event.Name,
+		ServiceName: event.Attributes[consts.ServiceLabelName],
+		ServiceType: event.ServiceType,
+		InstanceNum: event.Instance,
+		Color:       event.Color,
+	})
+}
+
+// Upper snake case an attribute name for use in an environment variable,
+// eg exitCode becomes EXIT_CODE and com.example.label COM_EXAMPLE_LABEL
+func eventEnvName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(toSnake(key)))
+}
+
+// Keep following project events, starting with any since the given time,
+// and pass each one to handle. The events stream is restarted if it exits.
+func followProjectEvents(projectName string, since string, handle func(*helpers.ContainerEvent)) {
+	events := make(chan *helpers.ContainerEvent)
+	go func() {
+		for event := range events {
+			handle(event)
+		}
+	}()
+
+	for {
+		ses, err := helpers.FollowProjectEvents(projectName, since, events)
+		if err != nil {
+			Warning.Println("Failed to follow docker events:", err)
+		} else {
+			ses.Wait()
+			Warning.Println("docker events exited, following again in", eventRetryInterval)
+		}
+		// only new events from now on
+		since = ""
+		time.Sleep(eventRetryInterval)
+	}
+}
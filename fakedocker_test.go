@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Put a `docker` script at the front of PATH and a config command for the
+// project in a temp dir, pointing the global flags at them. Every docker
+// call is appended to calls.log in the dir. The returned func restores them.
+func fakeDocker(t *testing.T, dockerScript string, config string) (dir string, restore func()) {
+	dir, err := ioutil.TempDir("", "capitan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docker := "#!/bin/bash\necho \"docker $*\" >> " + filepath.Join(dir, "calls.log") + "\n" + dockerScript + "\nexit 0\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(docker), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := "#!/bin/bash\ncat <<'EOT'\n" + config + "\nEOT\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "capitan.cfg.sh"), []byte(cfg), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		oldPath      = os.Getenv("PATH")
+		oldCommand   = command
+		oldStateFile = stateFile
+		oldArgs      = args
+	)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	command = filepath.Join(dir, "capitan.cfg.sh")
+	stateFile = filepath.Join(dir, "state.json")
+	args = nil
+
+	return dir, func() {
+		os.Setenv("PATH", oldPath)
+		command = oldCommand
+		stateFile = oldStateFile
+		args = oldArgs
+		os.RemoveAll(dir)
+	}
+}
@@ -2,6 +2,7 @@ package helpers
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	. "github.com/byrnedo/capitan/consts"
@@ -96,6 +97,164 @@ func GetContainerImageId(name string) string {
 
 }
 
+// A port published on the host
+type PublishedPort struct {
+	HostIp   string
+	HostPort string
+}
+
+// Details of a container as reported by docker inspect
+type ContainerDetails struct {
+	ID      string `json:"Id"`
+	ImageID string `json:"Image"`
+	// IP address on each network, keyed by network name
+	IPs map[string]string
+	// published ports keyed by container port, eg 80/tcp
+	Ports map[string][]PublishedPort
+}
+
+// Inspect a container for its ID, image ID, IPs and published ports
+func InspectContainer(name string) (*ContainerDetails, error) {
+	ses := sh.NewSession()
+	ses.Stderr = ioutil.Discard
+	out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{json .}}", name).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		ContainerDetails
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress string
+			}
+			Ports map[string][]PublishedPort
+		}
+	}
+	if err = json.Unmarshal(out, &raw); err != nil {
+		return nil, err
+	}
+
+	details := raw.ContainerDetails
+	details.IPs = make(map[string]string, len(raw.NetworkSettings.Networks))
+	for network, settings := range raw.NetworkSettings.Networks {
+		details.IPs[network] = settings.IPAddress
+	}
+	details.Ports = raw.NetworkSettings.Ports
+	return &details, nil
+}
+
+// The state of a container as reported by docker inspect
+type ContainerStatus struct {
+	// created, running, paused, restarting, removing, exited or dead
+	Status string
+	// starting, healthy or unhealthy, empty if there is no healthcheck
+	Health string
+	ExitCode int
+}
+
+// Get the run state, health and exit code of a container
+func GetContainerStatus(name string) (*ContainerStatus, error) {
+	ses := sh.NewSession()
+	ses.Stderr = ioutil.Discard
+	out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{.State.Status}}\t{{if .State.Health}}{{.State.Health.Status}}{{end}}\t{{.State.ExitCode}}", name).Output()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.Trim(string(out), " \n"), "\t")
+	if len(parts) < 3 {
+		return nil, errors.New("Unexpected inspect output for " + name)
+	}
+	exitCode, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	return &ContainerStatus{
+		Status: parts[0],
+		Health: parts[1],
+		ExitCode: exitCode,
+	}, nil
+}
+
+// Checks if a network exists
+func NetworkExists(name string) bool {
+	ses := sh.NewSession()
+	ses.Stderr = ioutil.Discard
+	_, err := ses.Command("docker", "network", "inspect", name).Output()
+	return err == nil
+}
+
+// Create a network labelled with the project name
+func CreateNetwork(name string, projName string, args []string) error {
+	cmd := []interface{}{"network", "create", "--label", ProjectLabelName + "=" + projName}
+	cmd = append(cmd, ToInterfaceSlice(args)...)
+	cmd = append(cmd, name)
+	_, err := RunCmd(cmd...)
+	return err
+}
+
+// Get the names of all networks labelled with the project name
+func GetProjectNetworks(projName string) ([]string, error) {
+	out, err := RunCmd("network", "ls", "-f", fmt.Sprintf("label=%s=%s", ProjectLabelName, projName), "--format", "{{.Name}}")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// Remove a network
+func RemoveNetwork(name string) error {
+	_, err := RunCmd("network", "rm", name)
+	return err
+}
+
+// Checks if a volume exists
+func VolumeExists(name string) bool {
+	ses := sh.NewSession()
+	ses.Stderr = ioutil.Discard
+	_, err := ses.Command("docker", "volume", "inspect", name).Output()
+	return err == nil
+}
+
+// Create a volume labelled with the project name
+func CreateVolume(name string, projName string, args []string) error {
+	cmd := []interface{}{"volume", "create", "--label", ProjectLabelName + "=" + projName}
+	cmd = append(cmd, ToInterfaceSlice(args)...)
+	cmd = append(cmd, name)
+	_, err := RunCmd(cmd...)
+	return err
+}
+
+// Get the names of all volumes labelled with the project name
+func GetProjectVolumes(projName string) ([]string, error) {
+	out, err := RunCmd("volume", "ls", "-q", "-f", fmt.Sprintf("label=%s=%s", ProjectLabelName, projName))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// Remove a volume
+func RemoveVolume(name string) error {
+	_, err := RunCmd("volume", "rm", name)
+	return err
+}
+
+// Get the ids of all images labelled with the project name
+func GetProjectImages(projName string) ([]string, error) {
+	out, err := RunCmd("images", "-q", "-f", fmt.Sprintf("label=%s=%s", ProjectLabelName, projName))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// Remove an image
+func RemoveImage(name string) error {
+	_, err := RunCmd("rmi", name)
+	return err
+}
+
 // Checks if a container exists
 func ContainerExists(name string) bool {
 	ses := sh.NewSession()
@@ -175,20 +334,23 @@ type ServiceState struct {
 	ID   string
 	Name string
 	ServiceName string
+	ServiceType string
 	InstanceNum int
 	Color string
 	Running bool
 	ArgsHash string
 }
 
-func GetProjectState(projName string, projSep string) (svcs map[string]*ServiceState, err error) {
+// Get the state of every container labelled with the project name, including
+// all colours of each instance
+func GetProjectContainers(projName string, projSep string) (svcs []*ServiceState, err error) {
 	ses := sh.NewSession()
 	out, err := ses.Command("docker",
 		"ps",
 		"-af",
 		fmt.Sprintf("label=%s=%s", ProjectLabelName, projName),
 		"--format",
-		fmt.Sprintf(`{{.ID}}\t{{.Names}}\t{{.Label "%s"}}\t{{.Label "%s"}}\t{{.Label "%s"}}\t{{.Status}}\t{{.Label "%s"}}`, ColorLabelName, ServiceLabelName, ContainerNumberLabelName, UniqueLabelName)).Output()
+		fmt.Sprintf(`{{.ID}}\t{{.Names}}\t{{.Label "%s"}}\t{{.Label "%s"}}\t{{.Label "%s"}}\t{{.Status}}\t{{.Label "%s"}}\t{{.Label "%s"}}`, ColorLabelName, ServiceLabelName, ContainerNumberLabelName, UniqueLabelName, ServiceLabelType)).Output()
 	if err != nil {
 		return
 	}
@@ -200,7 +362,7 @@ func GetProjectState(projName string, projSep string) (svcs map[string]*ServiceS
 
 	Debug.Println(string(out))
 
-	svcs = make(map[string]*ServiceState, 0)
+	svcs = make([]*ServiceState, 0)
 	for _, line := range bytes.Split(out, []byte{'\n'}) {
 		lineParts := bytes.Split(line, []byte{'\t'})
 
@@ -246,17 +408,58 @@ func GetProjectState(projName string, projSep string) (svcs map[string]*ServiceS
 			argsHash = string(lineParts[6])
 		}
 
-		name := filepath.Base(names)
-		svcs[serviceName + projSep + strconv.Itoa(instanceNum)] = &ServiceState{
+		var serviceType string
+		if len(lineParts) > 7 {
+			serviceType = string(lineParts[7])
+		}
+
+		svcs = append(svcs, &ServiceState{
 			ID: id,
-			Name: name,
+			Name: filepath.Base(names),
 			ServiceName: serviceName,
+			ServiceType: serviceType,
 			InstanceNum: instanceNum,
 			Color: color,
 			Running: running,
 			ArgsHash : argsHash,
-		}
+		})
 	}
 	return
 }
 
+// Get the state of the project's containers keyed by service name and instance number
+func GetProjectState(projName string, projSep string) (svcs map[string]*ServiceState, err error) {
+	var ctrs []*ServiceState
+	if ctrs, err = GetProjectContainers(projName, projSep); err != nil || ctrs == nil {
+		return
+	}
+	return CurrentInstances(ctrs, projSep), nil
+}
+
+// Pick the current container for each instance, keyed by service name and instance number.
+//
+// When more than one colour of an instance exists the running one wins,
+// otherwise the most recently created.
+func CurrentInstances(ctrs []*ServiceState, projSep string) map[string]*ServiceState {
+	svcs := make(map[string]*ServiceState, 0)
+	// docker ps lists the most recently created containers first
+	for _, ctr := range ctrs {
+		key := ctr.ServiceName + projSep + strconv.Itoa(ctr.InstanceNum)
+		if existing, found := svcs[key]; found && (existing.Running || !ctr.Running) {
+			continue
+		}
+		svcs[key] = ctr
+	}
+	return svcs
+}
+
+// Get the time a container last stopped
+func ContainerFinishedAt(name string) (time.Time, error) {
+	ses := sh.NewSession()
+	ses.Stderr = ioutil.Discard
+	out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{.State.FinishedAt}}", name).Output()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.Trim(string(out), " \n"))
+}
@@ -0,0 +1,116 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/byrnedo/capitan/consts"
+	"github.com/codeskyblue/go-sh"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A docker event for something labelled with a project, annotated with
+// capitan's labels
+type ContainerEvent struct {
+	Time time.Time `json:"time"`
+	// container, network, volume or image
+	Type string `json:"type"`
+	// eg start, die, oom or health_status
+	Action string `json:"action"`
+	// text docker puts after the action, eg "healthy" for health_status
+	Detail      string            `json:"detail,omitempty"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	ServiceType string            `json:"service_type"`
+	Instance    int               `json:"instance"`
+	Color       string            `json:"color"`
+	Attributes  map[string]string `json:"attributes"`
+}
+
+// The shape of `docker events --format '{{json .}}'`
+type dockerEvent struct {
+	Type   string
+	Action string
+	Actor  struct {
+		ID         string
+		Attributes map[string]string
+	}
+	TimeNano int64 `json:"timeNano"`
+}
+
+// Parse a line of `docker events --format '{{json .}}'`
+func ParseEvent(line []byte) (*ContainerEvent, error) {
+	var raw dockerEvent
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return nil, err
+	}
+
+	event := &ContainerEvent{
+		Time:       time.Unix(0, raw.TimeNano),
+		Type:       raw.Type,
+		Action:     raw.Action,
+		ID:         raw.Actor.ID,
+		Attributes: raw.Actor.Attributes,
+	}
+	if event.Attributes == nil {
+		event.Attributes = make(map[string]string)
+	}
+	if i := strings.Index(raw.Action, ":"); i >= 0 {
+		event.Action = raw.Action[:i]
+		event.Detail = strings.TrimSpace(raw.Action[i+1:])
+	}
+
+	event.Name = event.Attributes["name"]
+	event.ServiceType = event.Attributes[ServiceLabelType]
+	event.Color = event.Attributes[ColorLabelName]
+	event.Instance, _ = strconv.Atoi(event.Attributes[ContainerNumberLabelName])
+	return event, nil
+}
+
+// Splits `docker events` output into lines and sends each parsed event on a channel
+type eventWriter struct {
+	events chan<- *ContainerEvent
+	lock   sync.Mutex
+	buf    []byte
+}
+
+func (w *eventWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buf[:i]
+		w.buf = w.buf[i+1:]
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		event, err := ParseEvent(line)
+		if err != nil {
+			continue
+		}
+		w.events <- event
+	}
+	return len(b), nil
+}
+
+// Start following docker events for everything labelled with the project,
+// sending each one on the given channel. If since is set, eg "24h", earlier
+// events docker still has are sent first.
+func FollowProjectEvents(projName string, since string, events chan<- *ContainerEvent) (*sh.Session, error) {
+	args := []interface{}{"events", "--filter", "label=" + ProjectLabelName + "=" + projName, "--format", "{{json .}}"}
+	if since != "" {
+		args = append(args, "--since", since)
+	}
+	ses := sh.NewSession()
+	ses.Command("docker", args...)
+	ses.Stdout = &eventWriter{events: events}
+	err := ses.Start()
+	return ses, err
+}
@@ -17,3 +17,12 @@ func ToInterfaceSlice(data []string) (out []interface{}) {
 	}
 	return
 }
+
+func SliceContains(data []string, item string) bool {
+	for _, existing := range data {
+		if existing == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"github.com/codeskyblue/go-sh"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// A single resource usage sample for a container
+type ContainerStats struct {
+	Name       string
+	CPUPercent float64
+	MemUsage   uint64
+	MemLimit   uint64
+	NetRx      uint64
+	NetTx      uint64
+}
+
+var byteUnits = map[string]float64{
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// Take one sample of resource usage for the given containers
+func GetContainerStats(names []string) ([]*ContainerStats, error) {
+	args := []interface{}{"stats", "--no-stream", "--format", "{{.Name}}\t{{.CPUPerc}}\t{{.MemUsage}}\t{{.NetIO}}"}
+	args = append(args, ToInterfaceSlice(names)...)
+
+	ses := sh.NewSession()
+	ses.Stderr = ioutil.Discard
+	out, err := ses.Command("docker", args...).Output()
+	if err != nil {
+		return nil, errors.New("Error running docker stats:" + err.Error())
+	}
+	return ParseStats(out)
+}
+
+// Parse the tab separated output of `docker stats --format`
+// with name, cpu %, mem usage and net io columns
+func ParseStats(out []byte) ([]*ContainerStats, error) {
+	var stats []*ContainerStats
+	for _, line := range bytes.Split(bytes.Trim(out, "\n"), []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		parts := strings.Split(string(line), "\t")
+		if len(parts) < 4 {
+			return nil, errors.New("Unexpected stats line: " + string(line))
+		}
+
+		var (
+			stat = &ContainerStats{Name: parts[0]}
+			err  error
+		)
+		if cpu := strings.TrimSuffix(strings.TrimSpace(parts[1]), "%"); cpu != "--" {
+			if stat.CPUPercent, err = strconv.ParseFloat(cpu, 64); err != nil {
+				return nil, err
+			}
+		}
+		if stat.MemUsage, stat.MemLimit, err = parseBytePair(parts[2]); err != nil {
+			return nil, err
+		}
+		if stat.NetRx, stat.NetTx, err = parseBytePair(parts[3]); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// Parse a "used / total" pair of sizes
+func parseBytePair(pair string) (uint64, uint64, error) {
+	parts := strings.SplitN(pair, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Unexpected size pair: " + pair)
+	}
+	first, err := ParseByteSize(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	second, err := ParseByteSize(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, second, nil
+}
+
+// Parse a size as printed by docker, eg "1.5MiB" or "12kB"
+func ParseByteSize(size string) (uint64, error) {
+	size = strings.TrimSpace(size)
+	if size == "--" {
+		// not available, eg for a stopped container
+		return 0, nil
+	}
+	split := strings.IndexFunc(size, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if split < 0 {
+		split = len(size)
+	}
+	num, err := strconv.ParseFloat(size[:split], 64)
+	if err != nil {
+		return 0, errors.New("Invalid size: " + size)
+	}
+	unit := strings.ToLower(strings.TrimSpace(size[split:]))
+	if unit == "" {
+		unit = "b"
+	}
+	multiplier, found := byteUnits[unit]
+	if !found {
+		return 0, errors.New("Unknown size unit: " + size)
+	}
+	return uint64(num * multiplier), nil
+}
+
+// Format a number of bytes using binary units
+func FormatByteSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64) + units[i]
+}
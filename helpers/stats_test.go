@@ -0,0 +1,76 @@
+package helpers
+
+import (
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want uint64
+	}{
+		{"0B", 0},
+		{"512B", 512},
+		{"12kB", 12000},
+		{"1.5MiB", 1572864},
+		{"2GiB", 2 << 30},
+		{"1.2GB", 1200000000},
+		{"1TiB", 1 << 40},
+		{" 3.5 MB ", 3500000},
+		{"42", 42},
+		{"--", 0},
+	}
+	for _, test := range tests {
+		got, err := ParseByteSize(test.size)
+		if err != nil {
+			t.Errorf("ParseByteSize(%q): %s", test.size, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", test.size, got, test.want)
+		}
+	}
+
+	for _, size := range []string{"", "MiB", "1.2.3kB", "10XB"} {
+		if _, err := ParseByteSize(size); err == nil {
+			t.Errorf("ParseByteSize(%q) didn't fail", size)
+		}
+	}
+}
+
+func TestParseStats(t *testing.T) {
+	out := "demo_app_1\t95.50%\t10MiB / 1GiB\t1.5kB / 2kB\n" +
+		"\n" +
+		"demo_db_1\t--\t-- / --\t-- / --\n"
+
+	stats, err := ParseStats([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ContainerStats{
+		{Name: "demo_app_1", CPUPercent: 95.5, MemUsage: 10 << 20, MemLimit: 1 << 30, NetRx: 1500, NetTx: 2000},
+		{Name: "demo_db_1"},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("got %d stats, want %d", len(stats), len(want))
+	}
+	for i := range want {
+		if *stats[i] != want[i] {
+			t.Errorf("stats %d = %+v, want %+v", i, *stats[i], want[i])
+		}
+	}
+}
+
+func TestParseStatsErrors(t *testing.T) {
+	tests := []string{
+		"demo_app_1\t95%\t10MiB / 1GiB",
+		"demo_app_1\tlots\t10MiB / 1GiB\t1kB / 2kB",
+		"demo_app_1\t95%\t10MiB\t1kB / 2kB",
+		"demo_app_1\t95%\t10MiB / 1GiB\t1kB / 2XB",
+	}
+	for _, out := range tests {
+		if _, err := ParseStats([]byte(out)); err == nil {
+			t.Errorf("ParseStats(%q) didn't fail", out)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"github.com/codeskyblue/go-sh"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// how often the project is checked for new or removed containers
+	logPollInterval = 2 * time.Second
+)
+
+type logStarter func(set *container.Container, since time.Time) (*sh.Session, error)
+
+// Follows the logs of every running container of the given service types,
+// attaching to new instances and colours as they appear
+type logFollower struct {
+	settings     *ProjectConfig
+	serviceTypes map[string]bool
+	start        logStarter
+
+	lock sync.Mutex
+	// log sessions currently streaming
+	sessions map[string]*sh.Session
+	// when the stream of a container last ended, used to resume without repeats
+	ended map[string]time.Time
+	// whether the project has been checked yet
+	polled bool
+}
+
+func newLogFollower(settings *ProjectConfig, serviceTypes map[string]bool, start logStarter) *logFollower {
+	return &logFollower{
+		settings:     settings,
+		serviceTypes: serviceTypes,
+		start:        start,
+		sessions:     make(map[string]*sh.Session),
+		ended:        make(map[string]time.Time),
+	}
+}
+
+// Attach to the current containers then keep polling for changes in the background
+func (f *logFollower) Start() error {
+	if err := f.poll(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(logPollInterval) {
+			if err := f.poll(); err != nil {
+				// stderr, so json and merged output on stdout isn't broken
+				Error.Println("Failed to get project state:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (f *logFollower) poll() error {
+	states, err := helpers.GetProjectContainers(f.settings.ProjectName, f.settings.ProjectSeparator)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	present := make(map[string]bool, len(states))
+	for _, state := range states {
+		if !f.serviceTypes[state.ServiceType] {
+			continue
+		}
+		present[state.Name] = true
+		// stopped containers only get their recent output shown once
+		if !state.Running && f.polled {
+			continue
+		}
+		if _, following := f.sessions[state.Name]; following {
+			continue
+		}
+		f.follow(state)
+	}
+
+	f.polled = true
+
+	for name, ses := range f.sessions {
+		if !present[name] {
+			Debug.Println("No longer following", name)
+			ses.Kill(syscall.SIGTERM)
+			delete(f.sessions, name)
+		}
+	}
+	for name := range f.ended {
+		if !present[name] {
+			delete(f.ended, name)
+		}
+	}
+	return nil
+}
+
+// Start streaming a container, must be called with the lock held
+func (f *logFollower) follow(state *helpers.ServiceState) {
+	set := &container.Container{
+		Name:           state.Name,
+		ServiceType:    state.ServiceType,
+		InstanceNumber: state.InstanceNum,
+		State:          state,
+	}
+	if len(set.Name) > LongestContainerName {
+		LongestContainerName = len(set.Name)
+	}
+
+	ses, err := f.start(set, f.ended[set.Name])
+	if err != nil {
+		Error.Println("Error getting log for " + set.Name + ": " + err.Error())
+		return
+	}
+	f.sessions[set.Name] = ses
+
+	go func() {
+		ses.Wait()
+		// send any last line that didn't end in a newline
+		for _, out := range []interface{}{ses.Stdout, ses.Stderr} {
+			if w, ok := out.(*LogLineWriter); ok {
+				w.Flush()
+			}
+		}
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.sessions[set.Name] == ses {
+			delete(f.sessions, set.Name)
+		}
+		f.ended[set.Name] = time.Now()
+	}()
+}
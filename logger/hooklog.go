@@ -0,0 +1,47 @@
+package logger
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+)
+
+var (
+	// where hook output is also written, if set
+	hookLog *log.Logger
+)
+
+// Write hook output to the given file as well, replacing anything from
+// an earlier run
+func SetHookLogFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	hookLog = log.New(file, "", log.LstdFlags)
+	return nil
+}
+
+// Writes lines of hook output to the hook log with a plain prefix
+type hookFileWriter struct {
+	prefix string
+}
+
+func (w *hookFileWriter) Write(b []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.Trim(b, "\n"), []byte{'\n'}) {
+		hookLog.Printf("%s| %s", w.prefix, line)
+	}
+	return len(b), nil
+}
+
+// Writer for the output of a hook, prefixed with the name of the container
+// (or project) it ran for and "hook:<hook name>"
+func NewHookLogWriter(out io.Writer, name string, hookName string, color string) io.Writer {
+	prefix := name + " hook:" + hookName + " "
+	writer := NewContainerLogWriter(out, prefix, color)
+	if hookLog == nil {
+		return writer
+	}
+	return io.MultiWriter(writer, &hookFileWriter{prefix: prefix})
+}
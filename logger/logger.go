@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -53,9 +54,19 @@ func GetLevel() LogLevel {
 }
 
 func ContainerInfoLog(name string, msgs ...interface{}) {
+	Info.Println(containerLogLine(name, msgs)...)
+}
+
+// Like ContainerInfoLog but to the given writer, eg stderr when stdout is
+// used for json output
+func ContainerInfoLogTo(out io.Writer, name string, msgs ...interface{}) {
+	fmt.Fprintln(out, containerLogLine(name, msgs)...)
+}
+
+func containerLogLine(name string, msgs []interface{}) []interface{} {
 	var lenStr = strconv.Itoa(LongestContainerName)
 	var strs = []interface{}{fmt.Sprintf("%-"+lenStr+"s:", name)}
-	Info.Println(append(strs, msgs...)...)
+	return append(strs, msgs...)
 }
 
 func SetDebug() {
@@ -0,0 +1,190 @@
+package logger
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Where a log line came from
+type LogSource struct {
+	Container   string
+	ServiceType string
+	Instance    int
+	Color       string
+}
+
+// A single timestamped line of container output
+type LogLine struct {
+	Container   string    `json:"container"`
+	ServiceType string    `json:"service_type"`
+	Instance    int       `json:"instance"`
+	Color       string    `json:"color"`
+	Stream      string    `json:"stream"`
+	Timestamp   time.Time `json:"timestamp"`
+	Message     string    `json:"message"`
+
+	// the prefixed writer used for text output
+	text io.Writer
+	// when capitan received the line
+	received time.Time
+}
+
+// Write the line's message to its prefixed container writer
+func (l *LogLine) WriteText() {
+	l.text.Write([]byte(l.Message + "\n"))
+}
+
+// Splits `docker logs -t` output into timestamped lines and sends them on a channel.
+// A line split across writes is held until the rest of it arrives.
+type LogLineWriter struct {
+	lines  chan<- *LogLine
+	source LogSource
+	stream string
+	text   io.Writer
+	lock   sync.Mutex
+	buf    []byte
+}
+
+func NewLogLineWriter(lines chan<- *LogLine, source LogSource, stream string, text io.Writer) *LogLineWriter {
+	return &LogLineWriter{
+		lines:  lines,
+		source: source,
+		stream: stream,
+		text:   text,
+	}
+}
+
+func (w *LogLineWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := time.Now()
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buf[:i]
+		w.buf = w.buf[i+1:]
+		if len(line) == 0 {
+			continue
+		}
+		w.send(line, now)
+	}
+	return len(b), nil
+}
+
+// Send whatever is left of an unfinished line, for when the stream has ended
+func (w *LogLineWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.buf) > 0 {
+		w.send(w.buf, time.Now())
+		w.buf = nil
+	}
+}
+
+func (w *LogLineWriter) send(line []byte, received time.Time) {
+	timestamp, message := parseTimestampedLine(line, received)
+	w.lines <- &LogLine{
+		Container:   w.source.Container,
+		ServiceType: w.source.ServiceType,
+		Instance:    w.source.Instance,
+		Color:       w.source.Color,
+		Stream:      w.stream,
+		Timestamp:   timestamp,
+		Message:     message,
+		text:        w.text,
+		received:    received,
+	}
+}
+
+// Splits the leading docker timestamp from a line, falling back
+// to the time the line was received
+func parseTimestampedLine(line []byte, received time.Time) (time.Time, string) {
+	parts := bytes.SplitN(line, []byte{' '}, 2)
+	if len(parts) == 2 {
+		if timestamp, err := time.Parse(time.RFC3339Nano, string(parts[0])); err == nil {
+			return timestamp, string(parts[1])
+		}
+	}
+	return received, string(line)
+}
+
+type logLinesByTime []*LogLine
+
+func (l logLinesByTime) Len() int {
+	return len(l)
+}
+func (l logLinesByTime) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+func (l logLinesByTime) Less(i, j int) bool {
+	return l[i].Timestamp.Before(l[j].Timestamp)
+}
+
+// Reads lines from several containers and emits them in timestamp order.
+//
+// Lines are held back for `window` after they arrive so that slower
+// streams can catch up. Once a line has settled every buffered line with an
+// earlier or equal timestamp is emitted.
+func MergeLogLines(in <-chan *LogLine, window time.Duration, emit func(*LogLine)) {
+	var (
+		buffer []*LogLine
+		ticker = time.NewTicker(window / 2)
+	)
+	defer ticker.Stop()
+
+	flush := func(all bool) {
+		sort.Stable(logLinesByTime(buffer))
+		if all {
+			for _, line := range buffer {
+				emit(line)
+			}
+			buffer = buffer[:0]
+			return
+		}
+
+		var (
+			cutoff  time.Time
+			settled bool
+			horizon = time.Now().Add(-window)
+		)
+		for _, line := range buffer {
+			if line.received.Before(horizon) && line.Timestamp.After(cutoff) {
+				cutoff = line.Timestamp
+				settled = true
+			}
+		}
+		if !settled {
+			return
+		}
+		emitted := 0
+		for _, line := range buffer {
+			if line.Timestamp.After(cutoff) {
+				break
+			}
+			emit(line)
+			emitted++
+		}
+		buffer = append(buffer[:0], buffer[emitted:]...)
+	}
+
+	for {
+		select {
+		case line, ok := <-in:
+			if !ok {
+				flush(true)
+				return
+			}
+			buffer = append(buffer, line)
+		case <-ticker.C:
+			flush(false)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package logger
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLogLineWriterJoinsSplitLines(t *testing.T) {
+	lines := make(chan *LogLine, 10)
+	w := NewLogLineWriter(lines, LogSource{Container: "demo_app_1", ServiceType: "app", Instance: 1}, "stdout", ioutil.Discard)
+
+	w.Write([]byte("2016-01-02T15:04:05.123456789Z first line\n2016-01-02T15:04:06.5Z sec"))
+	w.Write([]byte("ond line\n"))
+	close(lines)
+
+	var got []*LogLine
+	for line := range lines {
+		got = append(got, line)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d lines, want 2", len(got))
+	}
+
+	want := []struct {
+		timestamp string
+		message   string
+	}{
+		{"2016-01-02T15:04:05.123456789Z", "first line"},
+		{"2016-01-02T15:04:06.5Z", "second line"},
+	}
+	for i, exp := range want {
+		timestamp, _ := time.Parse(time.RFC3339Nano, exp.timestamp)
+		if !got[i].Timestamp.Equal(timestamp) {
+			t.Errorf("line %d: timestamp %s, want %s", i, got[i].Timestamp, timestamp)
+		}
+		if got[i].Message != exp.message {
+			t.Errorf("line %d: message %q, want %q", i, got[i].Message, exp.message)
+		}
+		if got[i].Container != "demo_app_1" || got[i].Stream != "stdout" {
+			t.Errorf("line %d: wrong source %s %s", i, got[i].Container, got[i].Stream)
+		}
+	}
+}
+
+func TestLogLineWriterHoldsPartialLine(t *testing.T) {
+	lines := make(chan *LogLine, 10)
+	w := NewLogLineWriter(lines, LogSource{Container: "demo_app_1"}, "stderr", ioutil.Discard)
+
+	w.Write([]byte("2016-01-02T15:04:05Z no newline yet"))
+	if len(lines) != 0 {
+		t.Fatalf("sent %d lines before the line was finished", len(lines))
+	}
+	w.Write([]byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("sent %d lines, want 1", len(lines))
+	}
+	if line := <-lines; line.Message != "no newline yet" {
+		t.Errorf("message %q, want %q", line.Message, "no newline yet")
+	}
+}
+
+func TestLogLineWriterFlushesLastLine(t *testing.T) {
+	lines := make(chan *LogLine, 10)
+	w := NewLogLineWriter(lines, LogSource{Container: "demo_app_1"}, "stdout", ioutil.Discard)
+
+	w.Write([]byte("2016-01-02T15:04:05Z done\n2016-01-02T15:04:06Z exiting"))
+	w.Flush()
+	w.Flush()
+	close(lines)
+
+	var got []string
+	for line := range lines {
+		got = append(got, line.Message)
+	}
+	if len(got) != 2 || got[1] != "exiting" {
+		t.Fatalf("got %q, want the unfinished line sent once", got)
+	}
+}
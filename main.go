@@ -1,19 +1,43 @@
 package main
 
 import (
+	"errors"
 	"github.com/byrnedo/capitan/container"
 	. "github.com/byrnedo/capitan/logger"
 	"github.com/codegangsta/cli"
 	"os"
+	"strconv"
+	"time"
 )
 
 var (
-	command    string
-	args       []string
-	verboseLog bool
-	dryRun     bool
-	attach     bool
-	filter     string
+	command       string
+	args          []string
+	verboseLog    bool
+	dryRun        bool
+	attach        bool
+	filter        string
+	stateFile     string
+	hookLogFile   string
+	mergeLogs     bool
+	logFormat     string
+	wait          bool
+	waitTimeout   time.Duration
+	noStream      bool
+	statsOutput   string
+	eventsOutput  string
+	downOpts      DownOptions
+	removeOrphans bool
+
+	autoscaleInterval time.Duration
+	autoscaleCooldown time.Duration
+	watchInterval     time.Duration
+	watchDebounce     time.Duration
+	superviseOpts     SuperviseOptions
+)
+
+const (
+	defaultWaitTimeout = 2 * time.Minute
 )
 
 func main() {
@@ -39,6 +63,17 @@ func main() {
 			Usage:       "Preview outcome, no changes will be made",
 			Destination: &dryRun,
 		},
+		cli.StringFlag{
+			Name:        "state-file",
+			Value:       "./.capitan_state.json",
+			Usage:       "File to record runtime state in, such as scale overrides",
+			Destination: &stateFile,
+		},
+		cli.StringFlag{
+			Name:        "hook-log",
+			Usage:       "Also write hook output to this file, replacing it",
+			Destination: &hookLogFile,
+		},
 		cli.StringFlag{
 			Name:        "filter,f",
 			Value:       "",
@@ -56,6 +91,13 @@ func main() {
 			Info.Printf("Previewing changes...\n\n")
 		}
 
+		if hookLogFile != "" {
+			if err := SetHookLogFile(hookLogFile); err != nil {
+				Error.Println("Failed to open hook log:", err)
+				os.Exit(1)
+			}
+		}
+
 		args = c.Args()
 		return nil
 	}
@@ -74,20 +116,14 @@ func main() {
 				//first get settings
 				settings := getSettings()
 				settings.LaunchSignalWatcher()
-				if !settings.RunHook("before.up") {
+				exitCode, err := upProject(settings)
+				if err != nil {
+					Error.Println(err)
 					os.Exit(1)
 				}
-				if err := settings.ContainerCleanupList.CapitanRm([]string{"-f"}, dryRun); err != nil {
-					Warning.Println("Failed to scale down containers:", err)
-				}
-				if err := settings.ContainerList.CapitanUp(attach, dryRun); err != nil {
-					Error.Println("Up failed:", err)
-					os.Exit(1)
+				if exitCode != 0 {
+					os.Exit(exitCode)
 				}
-				if !settings.RunHook("after.up") {
-					os.Exit(1)
-				}
-
 				return nil
 
 			},
@@ -97,6 +133,70 @@ func main() {
 					Usage:       "attach to container output",
 					Destination: &attach,
 				},
+				cli.BoolFlag{
+					Name:        "remove-orphans",
+					Usage:       "stop and remove containers of services no longer in the config",
+					Destination: &removeOrphans,
+				},
+				cli.BoolFlag{
+					Name:        "wait,w",
+					Usage:       "wait for containers to be running and healthy, or exited",
+					Destination: &wait,
+				},
+				cli.DurationFlag{
+					Name:        "timeout,t",
+					Value:       defaultWaitTimeout,
+					Usage:       "how long to wait for containers",
+					Destination: &waitTimeout,
+				},
+			},
+		},
+		{
+			Name:    "watch",
+			Aliases: []string{},
+			Usage:   "Run up whenever the config changes",
+			Action: func(c *cli.Context) error {
+				runWatch(watchInterval, watchDebounce)
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:        "interval",
+					Value:       2 * time.Second,
+					Usage:       "how often to re-run the config command",
+					Destination: &watchInterval,
+				},
+				cli.DurationFlag{
+					Name:        "debounce",
+					Value:       time.Second,
+					Usage:       "how long a change must settle before it is applied",
+					Destination: &watchDebounce,
+				},
+				cli.BoolFlag{
+					Name:        "remove-orphans",
+					Usage:       "stop and remove containers of services no longer in the config",
+					Destination: &removeOrphans,
+				},
+			},
+		},
+		{
+			Name:    "wait",
+			Aliases: []string{},
+			Usage:   "Wait for containers to be running and healthy, or exited",
+			Action: func(c *cli.Context) error {
+				settings := getSettings()
+				if exitCode := waitForContainers(settings.ContainerList); exitCode != 0 {
+					os.Exit(exitCode)
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:        "timeout,t",
+					Value:       defaultWaitTimeout,
+					Usage:       "how long to wait for containers",
+					Destination: &waitTimeout,
+				},
 			},
 		},
 		{
@@ -108,7 +208,11 @@ func main() {
 				if !settings.RunHook("before.create") {
 					os.Exit(1)
 				}
-				if err := settings.ContainerCleanupList.CapitanRm([]string{"-f"}, dryRun); err != nil {
+				if err := createProjectResources(settings); err != nil {
+					Error.Println(err)
+					os.Exit(1)
+				}
+				if err := settings.ContainerCleanupList.CapitanCleanup(dryRun); err != nil {
 					Warning.Println("Failed to scale down containers:", err)
 				}
 				if err := settings.ContainerList.CapitanCreate(dryRun); err != nil {
@@ -131,7 +235,11 @@ func main() {
 				if !settings.RunHook("before.start") {
 					os.Exit(1)
 				}
-				if err := settings.ContainerCleanupList.CapitanRm([]string{"-f"}, dryRun); err != nil {
+				if err := createProjectResources(settings); err != nil {
+					Error.Println(err)
+					os.Exit(1)
+				}
+				if err := settings.ContainerCleanupList.CapitanCleanup(dryRun); err != nil {
 					Warning.Println("Failed to scale down containers:", err)
 				}
 				if err := settings.ContainerList.CapitanStart(attach, dryRun); err != nil {
@@ -158,22 +266,89 @@ func main() {
 			Usage:           "Number of instances to run of container",
 			SkipFlagParsing: true,
 			Action: func(c *cli.Context) error {
-				settings := getSettings()
-				if !settings.RunHook("before.scale") {
+				if err := scaleService(c.Args()); err != nil {
+					Error.Println("Scale failed:", err)
 					os.Exit(1)
 				}
-				if err := settings.ContainerCleanupList.Filter(func(i *container.Container) bool {
-					return i.ServiceType == c.Args().Get(0)
-				}).CapitanRm([]string{"-f"}, dryRun); err != nil {
-					Warning.Println("Failed to scale down containers:", err)
+				return nil
+			},
+		},
+		{
+			Name:    "autoscale",
+			Aliases: []string{},
+			Usage:   "Keep scaling services with an autoscale policy towards their cpu target",
+			Action: func(c *cli.Context) error {
+				runAutoscaler(autoscaleInterval, autoscaleCooldown)
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:        "interval",
+					Value:       30 * time.Second,
+					Usage:       "how often to sample stats",
+					Destination: &autoscaleInterval,
+				},
+				cli.DurationFlag{
+					Name:        "cooldown",
+					Value:       3 * time.Minute,
+					Usage:       "minimum time between scaling the same service",
+					Destination: &autoscaleCooldown,
+				},
+			},
+		},
+		{
+			Name:    "supervise",
+			Aliases: []string{},
+			Usage:   "Keep running missing instances and restarting crashed ones",
+			Action: func(c *cli.Context) error {
+				runSupervisor(superviseOpts)
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:        "interval",
+					Value:       10 * time.Second,
+					Usage:       "how often to check the project",
+					Destination: &superviseOpts.Interval,
+				},
+				cli.DurationFlag{
+					Name:        "backoff",
+					Value:       time.Second,
+					Usage:       "wait before restarting an instance again, doubled each time",
+					Destination: &superviseOpts.Backoff,
+				},
+				cli.DurationFlag{
+					Name:        "max-backoff",
+					Value:       5 * time.Minute,
+					Usage:       "longest wait between restarts, also how long an instance must run to reset its backoff",
+					Destination: &superviseOpts.MaxBackoff,
+				},
+				cli.IntFlag{
+					Name:        "max-restarts",
+					Value:       5,
+					Usage:       "restarts in a row before giving up on an instance, 0 for no limit",
+					Destination: &superviseOpts.MaxRestarts,
+				},
+			},
+		},
+		{
+			Name:    "rollback",
+			Aliases: []string{},
+			Usage:   "Start the previous colour of a service again and remove the current one",
+			Action: func(c *cli.Context) error {
+				if c.Args().Get(0) == "" {
+					Error.Println("Rollback failed: service name required")
+					os.Exit(1)
 				}
-				if err := settings.ContainerList.Filter(func(i *container.Container) bool {
-					return i.ServiceType == c.Args().Get(0)
-				}).CapitanUp(false, dryRun); err != nil {
-					Error.Println("Scale failed:", err)
+				settings := getSettings()
+				if !settings.RunHook("before.rollback") {
+					os.Exit(1)
+				}
+				if err := settings.CapitanRollback(c.Args().Get(0), dryRun); err != nil {
+					Error.Println("Rollback failed:", err)
 					os.Exit(1)
 				}
-				if !settings.RunHook("after.scale") {
+				if !settings.RunHook("after.rollback") {
 					os.Exit(1)
 				}
 				return nil
@@ -189,7 +364,7 @@ func main() {
 				if !settings.RunHook("before.restart") {
 					os.Exit(1)
 				}
-				if err := settings.ContainerCleanupList.CapitanRm([]string{"-f"}, dryRun); err != nil {
+				if err := settings.ContainerCleanupList.CapitanCleanup(dryRun); err != nil {
 					Warning.Println("Failed to scale down containers:", err)
 				}
 				if err := settings.ContainerList.CapitanRestart(c.Args(), dryRun); err != nil {
@@ -266,6 +441,55 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:    "volumes",
+			Aliases: []string{},
+			Usage:   "List volumes created for the project",
+			Action: func(c *cli.Context) error {
+				settings := getSettings()
+				if err := settings.CapitanVolumes(); err != nil {
+					Error.Println("Volumes failed:", err)
+					os.Exit(1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "down",
+			Aliases: []string{},
+			Usage:   "Stop and remove every container in the project",
+			Action: func(c *cli.Context) error {
+				settings := getSettings()
+				if !settings.RunHook("before.down") {
+					os.Exit(1)
+				}
+				if err := settings.CapitanDown(downOpts, filter, dryRun); err != nil {
+					Error.Println("Down failed:", err)
+					os.Exit(1)
+				}
+				if !settings.RunHook("after.down") {
+					os.Exit(1)
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "networks",
+					Usage:       "also remove project networks not declared in the config",
+					Destination: &downOpts.Networks,
+				},
+				cli.BoolFlag{
+					Name:        "volumes",
+					Usage:       "also remove project volumes",
+					Destination: &downOpts.Volumes,
+				},
+				cli.BoolFlag{
+					Name:        "images",
+					Usage:       "also remove images built by capitan",
+					Destination: &downOpts.Images,
+				},
+			},
+		},
 		{
 			Name:            "ps",
 			Aliases:         []string{},
@@ -333,27 +557,73 @@ func main() {
 			Usage:   "stream container logs",
 			Action: func(c *cli.Context) error {
 				settings := getSettings()
-				combined := append(settings.ContainerList, settings.ContainerCleanupList...)
-				if err := combined.CapitanLogs(); err != nil {
+				if err := settings.CapitanLogs(mergeLogs, logFormat); err != nil {
 					Error.Println("Logs failed:", err)
 					os.Exit(1)
 				}
 				return nil
 			},
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "merge,m",
+					Usage:       "emit lines in timestamp order across containers",
+					Destination: &mergeLogs,
+				},
+				cli.StringFlag{
+					Name:        "format",
+					Value:       "text",
+					Usage:       "output format, 'text' or 'json'",
+					Destination: &logFormat,
+				},
+			},
+		},
+		{
+			Name:    "events",
+			Aliases: []string{},
+			Usage:   "Follow docker events for the project",
+			Action: func(c *cli.Context) error {
+				settings := getSettings()
+				if err := settings.CapitanEvents(eventsOutput); err != nil {
+					Error.Println("Events failed:", err)
+					os.Exit(1)
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "output,o",
+					Value:       "text",
+					Usage:       "output format, text or json",
+					Destination: &eventsOutput,
+				},
+			},
 		},
 		{
 			Name:    "stats",
 			Aliases: []string{},
-			Usage:   "stream stats for all containers in project",
+			Usage:   "Show stats for all containers in project, grouped by service",
 			Action: func(c *cli.Context) error {
 				settings := getSettings()
 				combined := append(settings.ContainerList, settings.ContainerCleanupList...)
-				if err := combined.CapitanStats(); err != nil {
+				if err := combined.CapitanStats(!noStream, statsOutput); err != nil {
 					Error.Println("Stats failed:", err)
 					os.Exit(1)
 				}
 				return nil
 			},
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "no-stream",
+					Usage:       "print a single sample and exit",
+					Destination: &noStream,
+				},
+				cli.StringFlag{
+					Name:        "output,o",
+					Value:       "text",
+					Usage:       "output format, 'text' or 'json'",
+					Destination: &statsOutput,
+				},
+			},
 		},
 		{
 			Name:    "show",
@@ -376,13 +646,140 @@ func getSettings() (settings *ProjectConfig) {
 	var (
 		err error
 	)
-	runner := NewSettingsParser(command, args, filter)
-	if settings, err = runner.Run(); err != nil {
+	if settings, err = loadSettings(args); err != nil {
 		Error.Printf("Error running command: %s\n", err)
 		os.Exit(1)
 	}
+	return settings
+}
+
+// Run the config command and parse it as if capitan was given cmdArgs
+func loadSettings(cmdArgs cli.Args) (settings *ProjectConfig, err error) {
+	runner := NewSettingsParser(command, cmdArgs, filter, stateFile)
+	if settings, err = runner.Run(); err != nil {
+		return nil, err
+	}
 	if attach {
 		settings.IsInteractive = true
 	}
-	return settings
+	return settings, nil
+}
+
+// Create or update the project's containers as the `up` command does,
+// returning the exit code from waiting for them if --wait was given
+func upProject(settings *ProjectConfig) (int, error) {
+	if !settings.RunHook("before.up") {
+		return 0, errors.New("before.up hook failed")
+	}
+	if err := createProjectResources(settings); err != nil {
+		return 0, err
+	}
+	if removeOrphans {
+		if err := settings.CapitanRemoveOrphans(dryRun); err != nil {
+			return 0, errors.New("Failed to remove orphans: " + err.Error())
+		}
+	} else {
+		settings.ReportOrphans()
+	}
+	if err := settings.ContainerCleanupList.CapitanCleanup(dryRun); err != nil {
+		Warning.Println("Failed to scale down containers:", err)
+	}
+	if err := settings.ContainerList.CapitanUp(attach, dryRun); err != nil {
+		return 0, errors.New("Up failed: " + err.Error())
+	}
+	var exitCode int
+	if wait {
+		// blue/green and rolling updates leave instances under their other colour
+		current, err := settings.currentContainers(settings.ContainerList)
+		if err != nil {
+			return 0, errors.New("Failed to get project state: " + err.Error())
+		}
+		exitCode = waitForContainers(current)
+	}
+	if !settings.RunHook("after.up") {
+		return exitCode, errors.New("after.up hook failed")
+	}
+	return exitCode, nil
+}
+
+// Create the project's declared networks and volumes
+func createProjectResources(settings *ProjectConfig) error {
+	if err := settings.CapitanCreateNetworks(dryRun); err != nil {
+		return errors.New("Failed to create networks: " + err.Error())
+	}
+	if err := settings.CapitanCreateVolumes(dryRun); err != nil {
+		return errors.New("Failed to create volumes: " + err.Error())
+	}
+	return nil
+}
+
+// Scale a service to the number of instances given in scaleArgs, eg
+// "app 5", or back to its configured scale with "--reset app".
+//
+// The scale is recorded in the state file so later commands keep it.
+func scaleService(scaleArgs cli.Args) error {
+	var (
+		serviceType = scaleArgs.Get(0)
+		reset       bool
+	)
+	if serviceType == "--reset" {
+		reset = true
+		serviceType = scaleArgs.Get(1)
+	} else if scale, err := strconv.Atoi(scaleArgs.Get(1)); err != nil || scale < 1 {
+		return errors.New("Expected `scale <service> <instances>` or `scale --reset <service>`")
+	}
+	if serviceType == "" {
+		return errors.New("Service name required")
+	}
+
+	settings, err := loadSettings(append(cli.Args{"scale"}, scaleArgs...))
+	if err != nil {
+		return err
+	}
+	isService := func(i *container.Container) bool {
+		return i.ServiceType == serviceType
+	}
+	service := settings.ContainerList.Filter(isService)
+	if len(service) == 0 {
+		return errors.New("No such service: " + serviceType)
+	}
+
+	if !settings.RunHook("before.scale") {
+		return errors.New("before.scale hook failed")
+	}
+	if err := createProjectResources(settings); err != nil {
+		return err
+	}
+	if err := settings.ContainerCleanupList.Filter(isService).CapitanCleanup(dryRun); err != nil {
+		Warning.Println("Failed to scale down containers:", err)
+	}
+	if err := service.CapitanUp(false, dryRun); err != nil {
+		return err
+	}
+	if !settings.RunHook("after.scale") {
+		return errors.New("after.scale hook failed")
+	}
+
+	if dryRun {
+		return nil
+	}
+	if reset {
+		delete(settings.State.Scale, serviceType)
+	} else {
+		settings.State.Scale[serviceType] = service[0].Scale
+	}
+	return saveProjectState(stateFile, settings.ProjectName, settings.State)
+}
+
+// Wait for containers to be ready, returning the exit code capitan should use
+func waitForContainers(containers SettingsList) int {
+	exitCode, err := containers.CapitanWait(waitTimeout, dryRun)
+	if err != nil {
+		Error.Println("Wait failed:", err)
+		return 1
+	}
+	if exitCode != 0 {
+		Error.Println("Containers exited with code", exitCode)
+	}
+	return exitCode
 }
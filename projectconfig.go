@@ -1,28 +1,47 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/byrnedo/capitan/consts"
 	"github.com/byrnedo/capitan/container"
 	"github.com/byrnedo/capitan/helpers"
 	. "github.com/byrnedo/capitan/logger"
 	"github.com/codeskyblue/go-sh"
+	"math"
 	"os"
 	"os/signal"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"text/template"
+	"time"
 	"github.com/byrnedo/capitan/shellsession"
 )
 
 const projectShowTemplate = `-------------------------------------------------
   Project Name:  {{.ProjectName}}
   Blue/Green Mode (Global): {{.BlueGreenMode}}
+  Networks: {{range $ind, $network := .Networks}}
+    {{$network.Name}}{{range $arg := $network.Args}} {{$arg}}{{end}}{{end}}
+  Volumes: {{range $ind, $volume := .Volumes}}
+    {{$volume.Name}}{{range $arg := $volume.Args}} {{$arg}}{{end}}{{end}}
   Hooks (Global): {{range $key, $val := .Hooks}}
     {{$key}}
       {{range $hook := $val.Scripts}}{{$hook}}
       {{end}}{{end}}
+  Hook Definitions: {{range $key, $val := .HookDefs}}
+    @{{$key}}: {{$val}}{{end}}
+  Container Hooks (Global): {{range $key, $val := .ContainerHooks}}
+    {{$key}}
+      {{range $hook := $val.Scripts}}{{$hook}}
+      {{end}}{{end}}
+  Orphans: {{range $ind, $orphan := .OrphanList}}
+    {{$orphan.Name}} ({{$orphan.ServiceType}}){{end}}
 -------------------------------------------------
 `
 
@@ -38,20 +57,33 @@ const containerShowTemplate = `{{.Name}}:
   Build: {{.Build}}{{end}}
   Order: {{.Placement}}
   Blue/Green Mode: {{.BlueGreenMode}}
+  Networks: {{range $ind, $network := .Networks}}
+    {{$network.Name}}{{if $network.Alias}} (alias {{$network.Alias}}){{end}}{{end}}
   Links: {{range $ind, $link := .Links}}
     {{$link.Container}}{{if $link.Alias}}:{{$link.Alias}}{{end}}{{end}}
   Hooks: {{range $key, $val := .Hooks}}
     {{$key}}
       {{range $hook := $val.Scripts}}{{$hook}}
       {{end}}{{end}}
-  Scale: {{.Scale}}
+  Scale: {{.Scale}} ({{.ScaleSource}})
   Volumes From: {{range $ind, $val := .VolumesFrom}}
     {{$val}}{{end}}
+  Instance Volumes: {{range $ind, $val := .InstanceVolumes}}
+    {{$val.Name}}:{{$val.Mount}}{{end}}
   Run Args:   {{range $ind, $val := .RunArguments}}
     {{$val}}{{end}}
 -------------------------------------------------
 `
 
+const (
+	// how long merged log lines are held back for slower streams
+	logMergeWindow = 500 * time.Millisecond
+	// how often container readiness is checked when waiting
+	waitPollInterval = time.Second
+	// colour of the prefix on global hook output
+	projectHookColor = "white"
+)
+
 var (
 	allDone = make(chan bool, 1)
 )
@@ -64,12 +96,37 @@ type ProjectConfig struct {
 	ContainersState	     []*helpers.ServiceState
 	ContainerList        SettingsList
 	ContainerCleanupList SettingsList
+	// containers labelled with the project that match no configured service
+	OrphanList           SettingsList
+	// runtime state recorded by earlier commands
+	State                *ProjectState
 	Hooks 		     Hooks
+	// hooks run for every container, after its own
+	ContainerHooks       container.Hooks
+	// hook bodies referenced from hooks with @name
+	HookDefs             map[string]string
+	Networks             []*Network
+	Volumes              []*Volume
+}
+
+// A network declared for the project
+type Network struct {
+	Name string
+	// extra arguments to docker network create, eg the driver and its options
+	Args []string
+}
+
+// A named volume declared for the project
+type Volume struct {
+	Name string
+	// extra arguments to docker volume create, eg the driver and its options
+	Args []string
 }
 
 type Hook struct {
 	Scripts []string
 	Ses     *shellsession.ShellSession
+	Options container.HookOptions
 }
 
 type Hooks map[string]*Hook
@@ -87,18 +144,21 @@ func (h Hooks) Run(hookName string, settings *ProjectConfig) error {
 	}
 
 	for _, script := range hook.Scripts {
-		hook.Ses = shellsession.NewShellSession(func(s *shellsession.ShellSession){
-			s.SetEnv("CAPITAN_PROJECT_NAME", settings.ProjectName)
+		err = hook.Options.RunScript(hookName, func() *shellsession.ShellSession {
+			hook.Ses = shellsession.NewShellSession(func(s *shellsession.ShellSession){
+				s.SetEnv("CAPITAN_PROJECT_NAME", settings.ProjectName)
+			})
+			hook.Ses.SetEnv("CAPITAN_HOOK_NAME", hookName)
+			hook.Ses.SetEnv("CAPITAN_DRY_RUN", strconv.FormatBool(dryRun))
+
+			hook.Ses.Command("bash", "-c", script)
+
+			hook.Ses.Stdout = NewHookLogWriter(os.Stdout, settings.ProjectName, hookName, projectHookColor)
+			hook.Ses.Stderr = NewHookLogWriter(os.Stderr, settings.ProjectName, hookName, projectHookColor)
+			hook.Ses.Stdin = os.Stdin
+			return hook.Ses
 		})
-		hook.Ses.SetEnv("CAPITAN_HOOK_NAME", hookName)
-
-		hook.Ses.Command("bash", "-c", script)
-
-		hook.Ses.Stdout = os.Stdout
-		hook.Ses.Stderr = os.Stderr
-		hook.Ses.Stdin = os.Stdin
-
-		if err = hook.Ses.Run(); err != nil {
+		if err != nil {
 			return err
 		}
 	}
@@ -212,6 +272,67 @@ func (settings *ProjectConfig) RunHook(hookName string) bool {
 	return true
 }
 
+// Create any declared networks that don't exist yet
+func (settings *ProjectConfig) CapitanCreateNetworks(dryRun bool) error {
+	for _, network := range settings.Networks {
+		if helpers.NetworkExists(network.Name) {
+			Debug.Println("Network already exists:", network.Name)
+			continue
+		}
+		Info.Println("Creating network", network.Name)
+		if dryRun {
+			continue
+		}
+		if err := helpers.CreateNetwork(network.Name, settings.ProjectName, network.Args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create any declared volumes that don't exist yet
+func (settings *ProjectConfig) CapitanCreateVolumes(dryRun bool) error {
+	for _, volume := range settings.Volumes {
+		if helpers.VolumeExists(volume.Name) {
+			Debug.Println("Volume already exists:", volume.Name)
+			continue
+		}
+		Info.Println("Creating volume", volume.Name)
+		if dryRun {
+			continue
+		}
+		if err := helpers.CreateVolume(volume.Name, settings.ProjectName, volume.Args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List the volumes labelled with the project name
+func (settings *ProjectConfig) CapitanVolumes() error {
+	out, err := helpers.RunCmd("volume", "ls", "-f", fmt.Sprintf("label=%s=%s", consts.ProjectLabelName, settings.ProjectName))
+	if err != nil {
+		return err
+	}
+	Info.Print(string(out))
+	return nil
+}
+
+// Warn about containers that match no configured service
+func (settings *ProjectConfig) ReportOrphans() {
+	for _, orphan := range settings.OrphanList {
+		Warning.Printf("Found orphan container %s for service '%s' which is not in the config, use `up --remove-orphans` to remove it\n", orphan.Name, orphan.ServiceType)
+	}
+}
+
+// Stop and remove containers that match no configured service
+func (settings *ProjectConfig) CapitanRemoveOrphans(dryRun bool) error {
+	if err := settings.OrphanList.CapitanStop(nil, dryRun); err != nil {
+		return err
+	}
+	return settings.OrphanList.CapitanRm([]string{"-f"}, dryRun)
+}
+
 func (settings *ProjectConfig) CapitanPs(args []string) error {
 
 	allArgs := append([]interface{}{"ps"}, helpers.ToInterfaceSlice(args)...)
@@ -225,6 +346,7 @@ func (settings *ProjectConfig) CapitanPs(args []string) error {
 		return err
 	}
 	Info.Print(string(out))
+	settings.ReportOrphans()
 	return nil
 
 }
@@ -253,9 +375,8 @@ func newerImage(container string, image string) bool {
 	return false
 }
 
-func haveArgsChanged(container string, runArgs []interface{}) bool {
+func haveArgsChanged(container string, uniqueLabel string) bool {
 
-	uniqueLabel := helpers.HashInterfaceSlice(runArgs)
 	if helpers.GetContainerUniqueLabel(container) != uniqueLabel {
 		return true
 	}
@@ -308,13 +429,24 @@ func (settings SettingsList) CapitanCreate(dryRun bool) error {
 func (settings SettingsList) CapitanUp(attach bool, dryRun bool) error {
 	sort.Sort(settings)
 
-	wg := sync.WaitGroup{}
+	var (
+		wg = sync.WaitGroup{}
+		// instances of the current service waiting for a rolling or canary update
+		outdated SettingsList
+	)
 
 	for _, set := range settings {
 		var (
 			err error
 		)
 
+		if len(outdated) > 0 && outdated[0].ServiceType != set.ServiceType {
+			if err = outdated.updateService(attach, dryRun, &wg); err != nil {
+				return err
+			}
+			outdated = nil
+		}
+
 		if set.Build != "" {
 			ContainerInfoLog(set.Name, "Building image...")
 			if ! dryRun {
@@ -355,18 +487,13 @@ func (settings SettingsList) CapitanUp(attach bool, dryRun bool) error {
 		//			continue
 		//		}
 
-		if haveArgsChanged(set.Name, set.GetRunArguments()) {
-			// remove and restart
-			if set.BlueGreenMode == container.BGModeOn {
-				ContainerInfoLog(set.Name, "Run arguments changed, doing blue-green redeploy...")
-				if err = set.BlueGreenDeploy(attach, dryRun, &wg); err != nil {
-					return err
-				}
-			} else {
-				ContainerInfoLog(set.Name, "Removing (run arguments changed)")
-				if err = set.RecreateAndRun(attach, dryRun, &wg); err != nil {
-					return err
-				}
+		if haveArgsChanged(set.Name, set.RunArgumentsHash()) {
+			if set.UpdateParallelism > 0 || set.Strategy == container.StrategyCanary {
+				outdated = append(outdated, set)
+				continue
+			}
+			if err = set.Redeploy(attach, dryRun, &wg); err != nil {
+				return err
 			}
 			continue
 		}
@@ -396,6 +523,11 @@ func (settings SettingsList) CapitanUp(attach bool, dryRun bool) error {
 		continue
 
 	}
+	if len(outdated) > 0 {
+		if err := outdated.updateService(attach, dryRun, &wg); err != nil {
+			return err
+		}
+	}
 	wg.Wait()
 	if !dryRun && attach {
 		<-allDone
@@ -448,6 +580,294 @@ func (settings SettingsList) CapitanRestart(args []string, dryRun bool) error {
 	return nil
 }
 
+// Block until every container is running and healthy, or has exited.
+//
+// Returns the highest exit code of any exited container, or an error if
+// some containers were still not ready after the timeout.
+func (settings SettingsList) CapitanWait(timeout time.Duration, dryRun bool) (int, error) {
+	sort.Sort(settings)
+	if dryRun {
+		for _, set := range settings {
+			ContainerInfoLog(set.Name, "Waiting...")
+		}
+		return 0, nil
+	}
+
+	var (
+		exitCode int
+		pending  = settings
+		deadline = time.Now().Add(timeout)
+	)
+	for {
+		var stillPending SettingsList
+		for _, set := range pending {
+			if set.Remove {
+				// ran in the foreground and was removed on exit
+				continue
+			}
+			status, err := helpers.GetContainerStatus(set.Name)
+			if err != nil {
+				Debug.Println("Failed to inspect", set.Name, err)
+				stillPending = append(stillPending, set)
+				continue
+			}
+			switch {
+			case status.Status == "exited" || status.Status == "dead":
+				ContainerInfoLog(set.Name, "Exited with code", status.ExitCode)
+				if status.ExitCode > exitCode {
+					exitCode = status.ExitCode
+				}
+			case status.Status == "running" && (status.Health == "" || status.Health == "healthy"):
+				ContainerInfoLog(set.Name, "Ready")
+			default:
+				stillPending = append(stillPending, set)
+			}
+		}
+		pending = stillPending
+
+		if len(pending) == 0 {
+			return exitCode, nil
+		}
+		if time.Now().After(deadline) {
+			names := make([]string, len(pending))
+			for i, set := range pending {
+				names[i] = set.Name
+			}
+			return exitCode, errors.New("Timed out waiting for " + strings.Join(names, ", "))
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+// The given instances as they are now. A deploy may have replaced an
+// instance with its other colour, so its name and state are looked up again.
+// Instances with no container, eg ones run with rm, are returned as is.
+func (settings *ProjectConfig) currentContainers(list SettingsList) (SettingsList, error) {
+	state, err := helpers.GetProjectState(settings.ProjectName, settings.ProjectSeparator)
+	if err != nil {
+		return nil, err
+	}
+	current := make(SettingsList, 0, len(list))
+	for _, set := range list {
+		existing, found := state[set.ServiceName+settings.ProjectSeparator+strconv.Itoa(set.InstanceNumber)]
+		if !found {
+			current = append(current, set)
+			continue
+		}
+		ctr := new(container.Container)
+		*ctr = *set
+		ctr.Name = existing.Name
+		ctr.State = existing
+		current = append(current, ctr)
+	}
+	return current, nil
+}
+
+// Roll a service back to the colours kept by bg-keep.
+//
+// For each instance the kept container is started again, its switch hook is
+// run and the current colour is removed.
+func (settings *ProjectConfig) CapitanRollback(serviceType string, dryRun bool) error {
+	ctrs, err := helpers.GetProjectContainers(settings.ProjectName, settings.ProjectSeparator)
+	if err != nil {
+		return err
+	}
+
+	current := settings.ContainerList.Filter(func(i *container.Container) bool {
+		return i.ServiceType == serviceType
+	})
+	if len(current) == 0 {
+		return errors.New("No such service: " + serviceType)
+	}
+	sort.Sort(current)
+
+	var (
+		wg       sync.WaitGroup
+		previous = make(SettingsList, len(current))
+		found    bool
+	)
+	for i, set := range current {
+		for _, existing := range ctrs {
+			if existing.ServiceName == set.ServiceName &&
+				existing.InstanceNum == set.InstanceNumber &&
+				existing.Color != set.State.Color {
+				prev := new(container.Container)
+				*prev = *set
+				prev.Name = existing.Name
+				prev.State = existing
+				prev.PreviousColor = set.State.Color
+				previous[i] = prev
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return errors.New("No previous colour kept for " + serviceType + ", is bg-keep set?")
+	}
+
+	for i, set := range current {
+		prev := previous[i]
+		if prev == nil {
+			ContainerInfoLog(set.Name, "No previous colour kept, leaving as is")
+			continue
+		}
+		ContainerInfoLog(prev.Name, "Rolling back from "+set.Name+"...")
+		if dryRun {
+			continue
+		}
+		if err := prev.Start(false, &wg); err != nil {
+			return err
+		}
+		if err := prev.Hooks.Run("switch", prev); err != nil {
+			return err
+		}
+		ContainerInfoLog(prev.Name, "Removing failed container "+set.Name+"...")
+		if err := set.Rm([]string{"-f"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// What `down` removes besides containers
+type DownOptions struct {
+	Networks bool
+	Volumes  bool
+	Images   bool
+}
+
+// Tear down the project.
+//
+// Containers are found by the project label rather than the config, so
+// every colour, scaled down leftover and container of a service since
+// deleted from the config is stopped in reverse order and removed.
+// Declared networks are removed, and optionally any other project networks,
+// volumes and built images.
+func (settings *ProjectConfig) CapitanDown(opts DownOptions, filter string, dryRun bool) error {
+	ctrs, err := helpers.GetProjectContainers(settings.ProjectName, settings.ProjectSeparator)
+	if err != nil {
+		return err
+	}
+
+	var (
+		configured = append(settings.ContainerList, settings.ContainerCleanupList...)
+		toRemove   SettingsList
+	)
+	for _, existing := range ctrs {
+		if filter != "" && existing.ServiceType != filter {
+			continue
+		}
+		toRemove = append(toRemove, settings.containerFromState(configured, existing))
+	}
+
+	if err = toRemove.CapitanStop(nil, dryRun); err != nil {
+		return err
+	}
+	if err = toRemove.CapitanRm([]string{"-f"}, dryRun); err != nil {
+		return err
+	}
+
+	if filter != "" {
+		if opts.Networks || opts.Volumes || opts.Images {
+			Warning.Println("Not removing networks, volumes or images when filtering")
+		}
+		return nil
+	}
+
+	// the declared networks capitan created are always removed, any other
+	// project labelled ones only with --networks
+	labelled, err := helpers.GetProjectNetworks(settings.ProjectName)
+	if err != nil {
+		return err
+	}
+	var networks []string
+	for _, network := range settings.Networks {
+		if helpers.SliceContains(labelled, network.Name) {
+			networks = append(networks, network.Name)
+		}
+	}
+	if opts.Networks {
+		for _, network := range labelled {
+			if !helpers.SliceContains(networks, network) {
+				networks = append(networks, network)
+			}
+		}
+	}
+	for _, network := range networks {
+		Info.Println("Removing network", network)
+		if dryRun {
+			continue
+		}
+		if err := helpers.RemoveNetwork(network); err != nil {
+			return err
+		}
+	}
+
+	if opts.Volumes {
+		volumes, err := helpers.GetProjectVolumes(settings.ProjectName)
+		if err != nil {
+			return err
+		}
+		for _, volume := range volumes {
+			Info.Println("Removing volume", volume)
+			if dryRun {
+				continue
+			}
+			if err := helpers.RemoveVolume(volume); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.Images {
+		images, err := helpers.GetProjectImages(settings.ProjectName)
+		if err != nil {
+			return err
+		}
+		// images built before they were labelled
+		for _, set := range configured {
+			if set.Build != "" && !helpers.SliceContains(images, set.Image) && helpers.GetImageId(set.Image) != "" {
+				images = append(images, set.Image)
+			}
+		}
+		for _, image := range images {
+			Info.Println("Removing image", image)
+			if dryRun {
+				continue
+			}
+			if err := helpers.RemoveImage(image); err != nil {
+				Warning.Println("Failed to remove image", image+":", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Create a container for an existing project container, using the config of
+// its service if there is one so hooks are run. Containers of services not in
+// the config are ordered before all others.
+func (settings *ProjectConfig) containerFromState(configured SettingsList, state *helpers.ServiceState) *container.Container {
+	ctr := &container.Container{
+		ServiceType:          state.ServiceType,
+		ServiceName:          state.ServiceName,
+		ProjectName:          settings.ProjectName,
+		ProjectNameSeparator: settings.ProjectSeparator,
+		Placement:            math.MaxInt32,
+		Hooks:                make(container.Hooks),
+	}
+	for _, set := range configured {
+		if set.ServiceType == state.ServiceType {
+			*ctr = *set
+			break
+		}
+	}
+	ctr.Name = state.Name
+	ctr.InstanceNumber = state.InstanceNum
+	ctr.State = state
+	return ctr
+}
+
 // Print all container IPs
 func (settings SettingsList) CapitanIP() error {
 	sort.Sort(settings)
@@ -459,49 +879,262 @@ func (settings SettingsList) CapitanIP() error {
 }
 
 // Stream all container logs
-func (settings SettingsList) CapitanLogs() error {
-	sort.Sort(settings)
-	var wg sync.WaitGroup
-	for _, set := range settings {
-		var (
-			ses *sh.Session
-			err error
-		)
-		if ses, err = set.Logs(); err != nil {
-			Error.Println("Error getting log for " + set.Name + ": " + err.Error())
-			continue
+//
+// Containers are followed as they appear in the project, so instances and
+// colours created by a redeploy are picked up and removed ones are dropped.
+// If merge is set lines are emitted in docker timestamp order instead of
+// arrival order. Format is either "text" or "json".
+func (settings *ProjectConfig) CapitanLogs(merge bool, format string) error {
+	if format != "text" && format != "json" {
+		return errors.New("Unknown log format: " + format)
+	}
+
+	serviceTypes := make(map[string]bool)
+	for _, set := range append(settings.ContainerList, settings.ContainerCleanupList...) {
+		serviceTypes[set.ServiceType] = true
+	}
+
+	if !merge && format == "text" {
+		follower := newLogFollower(settings, serviceTypes, func(set *container.Container, since time.Time) (*sh.Session, error) {
+			return set.Logs(since)
+		})
+		if err := follower.Start(); err != nil {
+			return err
 		}
+		select {}
+	}
 
-		wg.Add(1)
+	var (
+		lines = make(chan *LogLine)
+		enc   = json.NewEncoder(os.Stdout)
+	)
+	follower := newLogFollower(settings, serviceTypes, func(set *container.Container, since time.Time) (*sh.Session, error) {
+		return set.LogLines(lines, since)
+	})
+	if err := follower.Start(); err != nil {
+		return err
+	}
 
-		go func() {
-			ses.Wait()
-			wg.Done()
-		}()
+	emit := func(line *LogLine) {
+		if format == "json" {
+			enc.Encode(line)
+			return
+		}
+		line.WriteText()
+	}
 
+	if merge {
+		MergeLogLines(lines, logMergeWindow, emit)
+		return nil
+	}
+	for line := range lines {
+		emit(line)
 	}
-	wg.Wait()
 	return nil
 }
 
-// Stream all container stats
-func (settings SettingsList) CapitanStats() error {
+// Follow docker events for the project until interrupted, running the
+// on.<action> hooks of the services they are for.
+//
+// Output is either "text" or "json".
+func (settings *ProjectConfig) CapitanEvents(output string) error {
+	if output != "text" && output != "json" {
+		return errors.New("Unknown output format: " + output)
+	}
+
+	var (
+		events = make(chan *helpers.ContainerEvent)
+		enc    = json.NewEncoder(os.Stdout)
+	)
+	ses, err := helpers.FollowProjectEvents(settings.ProjectName, "", events)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- ses.Wait()
+	}()
+
+	for {
+		select {
+		case event := <-events:
+			if output == "json" {
+				enc.Encode(event)
+				// keep stdout to json
+				settings.RunEventHook(event, os.Stderr)
+			} else {
+				printEvent(event)
+				settings.RunEventHook(event, os.Stdout)
+			}
+		case err := <-done:
+			if err == nil {
+				err = errors.New("docker events exited")
+			}
+			return err
+		}
+	}
+}
+
+// Labels and attributes already shown elsewhere in an event's text output
+var shownEventAttributes = []string{
+	"name",
+	consts.UniqueLabelName,
+	consts.ServiceLabelName,
+	consts.ServiceLabelType,
+	consts.ProjectLabelName,
+	consts.ContainerNumberLabelName,
+	consts.ColorLabelName,
+}
+
+func printEvent(event *helpers.ContainerEvent) {
 	var (
-		args []interface{}
+		name   = event.Name
+		action = event.Action
+		attrs  []string
 	)
+	if name == "" {
+		name = event.ID
+	}
+	if event.ServiceType != "" {
+		name += fmt.Sprintf(" (%s #%d %s)", event.ServiceType, event.Instance, event.Color)
+	}
+	if event.Detail != "" {
+		action += ": " + event.Detail
+	}
+	for key, val := range event.Attributes {
+		if !helpers.SliceContains(shownEventAttributes, key) {
+			attrs = append(attrs, key+"="+val)
+		}
+	}
+	sort.Strings(attrs)
+
+	line := fmt.Sprintf("%s %s %s %s", event.Time.Format(time.RFC3339), event.Type, name, action)
+	if len(attrs) > 0 {
+		line += " " + strings.Join(attrs, " ")
+	}
+	fmt.Println(line)
+}
+
+// Resource usage summed across the instances of a service
+type ServiceStats struct {
+	ServiceType string  `json:"service_type"`
+	Instances   int     `json:"instances"`
+	CPUPercent  float64 `json:"cpu_percent"`
+	MemUsage    uint64  `json:"mem_usage_bytes"`
+	NetRx       uint64  `json:"net_rx_bytes"`
+	NetTx       uint64  `json:"net_tx_bytes"`
+}
+
+// A stats sample for the whole project
+type ProjectStats struct {
+	Time     time.Time       `json:"time"`
+	Services []*ServiceStats `json:"services"`
+}
+
+// Sample stats for all running containers of the services and group them by
+// service type. The containers are looked up again on each call.
+func (settings SettingsList) SampleStats() (*ProjectStats, error) {
 	sort.Sort(settings)
 
-	args = make([]interface{}, len(settings))
+	var (
+		names        []string
+		serviceTypes = make(map[string]string)
+		byService    = make(map[string]*ServiceStats)
+		sample       = &ProjectStats{Time: time.Now(), Services: make([]*ServiceStats, 0)}
+	)
+	if len(settings) == 0 {
+		return sample, nil
+	}
+	for _, set := range settings {
+		if _, found := byService[set.ServiceType]; !found {
+			byService[set.ServiceType] = &ServiceStats{ServiceType: set.ServiceType}
+			sample.Services = append(sample.Services, byService[set.ServiceType])
+		}
+	}
 
-	for i, set := range settings {
-		args[i] = set.Name
+	// read the containers again rather than trusting the state from when the
+	// config was loaded, they may have been replaced or removed since
+	ctrs, err := helpers.GetProjectContainers(settings[0].ProjectName, settings[0].ProjectNameSeparator)
+	if err != nil {
+		return nil, err
+	}
+	for _, ctr := range ctrs {
+		if _, found := byService[ctr.ServiceType]; !found || !ctr.Running {
+			continue
+		}
+		names = append(names, ctr.Name)
+		serviceTypes[ctr.Name] = ctr.ServiceType
+	}
+	if len(names) == 0 {
+		return sample, nil
 	}
 
-	ses := sh.NewSession()
-	ses.Command("docker", append([]interface{}{"stats"}, args...)...)
-	ses.Start()
-	ses.Wait()
-	return nil
+	stats, err := helpers.GetContainerStats(names)
+	if err != nil {
+		return nil, err
+	}
+	for _, stat := range stats {
+		svc := byService[serviceTypes[stat.Name]]
+		if svc == nil {
+			continue
+		}
+		svc.Instances++
+		svc.CPUPercent += stat.CPUPercent
+		svc.MemUsage += stat.MemUsage
+		svc.NetRx += stat.NetRx
+		svc.NetTx += stat.NetTx
+	}
+	return sample, nil
+}
+
+// Show stats for all containers in project, grouped by service type.
+//
+// Output is either "text" or "json". Unless stream is false it keeps
+// sampling until interrupted.
+func (settings SettingsList) CapitanStats(stream bool, output string) error {
+	if output != "text" && output != "json" {
+		return errors.New("Unknown output format: " + output)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		sample, err := settings.SampleStats()
+		if err != nil {
+			if !stream {
+				return err
+			}
+			// eg a container went away between listing and sampling
+			Warning.Println("Failed to sample stats:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if output == "json" {
+			enc.Encode(sample)
+		} else {
+			if stream {
+				// clear the screen between samples
+				fmt.Print("\033[H\033[2J")
+			}
+			printStats(sample)
+		}
+		if !stream {
+			return nil
+		}
+	}
+}
+
+func printStats(sample *ProjectStats) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tINSTANCES\tCPU %\tMEM USAGE\tNET RX\tNET TX")
+	for _, svc := range sample.Services {
+		fmt.Fprintf(w, "%s\t%d\t%.2f%%\t%s\t%s\t%s\n",
+			svc.ServiceType,
+			svc.Instances,
+			svc.CPUPercent,
+			helpers.FormatByteSize(svc.MemUsage),
+			helpers.FormatByteSize(svc.NetRx),
+			helpers.FormatByteSize(svc.NetTx))
+	}
+	w.Flush()
 }
 
 // Kill all running containers in project
@@ -540,6 +1173,29 @@ func (settings SettingsList) CapitanStop(args []string, dryRun bool) error {
 	return nil
 }
 
+// Gracefully stop and remove surplus instances and expired colours,
+// highest instance numbers first
+func (settings SettingsList) CapitanCleanup(dryRun bool) error {
+	sort.Sort(sort.Reverse(settings))
+	for _, set := range settings {
+		if set.State != nil && set.State.Running {
+			ContainerInfoLog(set.Name, "Stopping (scaling down)...")
+			if !dryRun {
+				if err := set.Stop(nil); err != nil {
+					return err
+				}
+			}
+		}
+		ContainerInfoLog(set.Name, "Removing....")
+		if !dryRun {
+			if err := set.Rm([]string{"-f"}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Remove all containers in project
 func (settings SettingsList) CapitanRm(args []string, dryRun bool) error {
 	sort.Sort(sort.Reverse(settings))
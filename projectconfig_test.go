@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The backend network is declared and created by capitan, other is only
+// labelled with the project
+const downDocker = `case "$1 $2" in
+  "network ls")
+    printf 'backend\nother\n'
+    ;;
+esac`
+
+func downNetworkRemovals(t *testing.T, opts DownOptions) []string {
+	dir, restore := fakeDocker(t, downDocker, "global project demo\nglobal network backend\napp image nginx")
+	defer restore()
+
+	settings, err := loadSettings(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = settings.CapitanDown(opts, "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	calls, err := ioutil.ReadFile(filepath.Join(dir, "calls.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var removed []string
+	for _, call := range strings.Split(string(calls), "\n") {
+		if strings.HasPrefix(call, "docker network rm ") {
+			removed = append(removed, strings.TrimPrefix(call, "docker network rm "))
+		}
+	}
+	return removed
+}
+
+func TestDownRemovesDeclaredNetworks(t *testing.T) {
+	removed := downNetworkRemovals(t, DownOptions{})
+	if strings.Join(removed, ",") != "backend" {
+		t.Fatalf("removed networks %v, want [backend]", removed)
+	}
+}
+
+func TestDownNetworksRemovesAllProjectNetworks(t *testing.T) {
+	removed := downNetworkRemovals(t, DownOptions{Networks: true})
+	if strings.Join(removed, ",") != "backend,other" {
+		t.Fatalf("removed networks %v, want [backend other]", removed)
+	}
+}
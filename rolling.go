@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/byrnedo/capitan/container"
+	. "github.com/byrnedo/capitan/logger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Replace the outdated instances of a single service according to its
+// deploy strategy and update settings
+func (settings SettingsList) updateService(attach bool, dryRun bool, wg *sync.WaitGroup) error {
+	first := settings[0]
+	switch {
+	case first.Strategy == container.StrategyCanary:
+		return settings.canaryUpdate(attach, dryRun, wg)
+	case first.UpdateParallelism > 0:
+		return settings.rollingUpdate(attach, dryRun, wg)
+	}
+	for _, set := range settings {
+		if err := set.Redeploy(attach, dryRun, wg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace outdated instances of a single service in batches of its
+// update-parallelism, waiting for each batch to be healthy before starting
+// the next so the service never fully disappears.
+func (settings SettingsList) rollingUpdate(attach bool, dryRun bool, wg *sync.WaitGroup) error {
+	var (
+		first       = settings[0]
+		parallelism = first.UpdateParallelism
+	)
+
+	for start := 0; start < len(settings); start += parallelism {
+		end := start + parallelism
+		if end > len(settings) {
+			end = len(settings)
+		}
+		batch := settings[start:end]
+
+		if start > 0 && first.UpdateDelay > 0 {
+			ContainerInfoLog(first.ServiceName, "Waiting "+first.UpdateDelay.String()+" before next batch...")
+			if !dryRun {
+				time.Sleep(first.UpdateDelay)
+			}
+		}
+
+		ContainerInfoLog(first.ServiceName, fmt.Sprintf("Run arguments changed, updating outdated instances %d-%d of %d...", start+1, end, len(settings)))
+
+		var err error
+		if first.UpdateStartsFirst() {
+			err = batch.startFirstUpdate(attach, dryRun, wg)
+		} else {
+			err = batch.stopFirstUpdate(attach, dryRun, wg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run new colours of each instance, wait for them, then remove the old ones.
+// If anything fails the new containers are removed and the old ones keep running.
+func (settings SettingsList) startFirstUpdate(attach bool, dryRun bool, wg *sync.WaitGroup) error {
+	newCons, err := settings.runNewColors(attach, dryRun, wg)
+	if err != nil {
+		return err
+	}
+	return settings.removeOldColors(newCons, dryRun)
+}
+
+// Run the other colour of each instance and wait for them to be ready.
+// If anything fails the new containers are removed again.
+func (settings SettingsList) runNewColors(attach bool, dryRun bool, wg *sync.WaitGroup) (SettingsList, error) {
+	newCons := make(SettingsList, 0, len(settings))
+
+	for _, set := range settings {
+		newCon := set.BlueGreenCopy()
+		if err := newCon.RemoveKeptColor(dryRun); err != nil {
+			newCons.discard(dryRun)
+			return nil, err
+		}
+		newCons = append(newCons, newCon)
+		if err := newCon.Run(attach, dryRun, wg); err != nil {
+			newCons.discard(dryRun)
+			return nil, err
+		}
+	}
+
+	if err := waitForBatch(newCons, dryRun); err != nil {
+		newCons.discard(dryRun)
+		return nil, err
+	}
+	return newCons, nil
+}
+
+// Hand over from the old colour of each instance now that its replacement is running
+func (settings SettingsList) removeOldColors(newCons SettingsList, dryRun bool) error {
+	for i, set := range settings {
+		if err := set.HandOver(newCons[i], dryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Force remove containers that failed to deploy
+func (settings SettingsList) discard(dryRun bool) {
+	Warning.Println("Error deploying new containers, removing...")
+	for _, set := range settings {
+		ContainerInfoLog(set.Name, "Removing...")
+		if !dryRun {
+			set.Rm([]string{"-f"})
+		}
+	}
+}
+
+// Remove each instance, then run the new ones and wait for them
+func (settings SettingsList) stopFirstUpdate(attach bool, dryRun bool, wg *sync.WaitGroup) error {
+	for _, set := range settings {
+		ContainerInfoLog(set.Name, "Removing (run arguments changed)")
+		if !dryRun {
+			set.Rm([]string{"-f"})
+		}
+	}
+	for _, set := range settings {
+		if err := set.Run(attach, dryRun, wg); err != nil {
+			return err
+		}
+	}
+	return waitForBatch(settings, dryRun)
+}
+
+// Wait for a batch of updated containers to be ready, for the service's
+// update-timeout, or else the --timeout given to the command
+func waitForBatch(settings SettingsList, dryRun bool) error {
+	timeout := settings[0].UpdateTimeout
+	if timeout == 0 {
+		timeout = waitTimeout
+	}
+	if timeout == 0 {
+		// commands without a --timeout flag
+		timeout = defaultWaitTimeout
+	}
+	exitCode, err := settings.CapitanWait(timeout, dryRun)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return errors.New("Container exited with code " + strconv.Itoa(exitCode))
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// Runtime state for a project that outlives a single command
+type ProjectState struct {
+	// scale set with the `scale` command, keyed by service type
+	Scale map[string]int `json:"scale"`
+}
+
+// Read the state for a project, an empty state is returned if
+// the file doesn't exist yet
+func loadProjectState(path string, projectName string) (*ProjectState, error) {
+	all, err := readStateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := all[projectName]
+	if state == nil {
+		state = new(ProjectState)
+	}
+	if state.Scale == nil {
+		state.Scale = make(map[string]int)
+	}
+	return state, nil
+}
+
+// Write the state for a project, leaving other projects in the file untouched
+func saveProjectState(path string, projectName string, state *ProjectState) error {
+	all, err := readStateFile(path)
+	if err != nil {
+		return err
+	}
+	all[projectName] = state
+
+	out, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+func readStateFile(path string) (map[string]*ProjectState, error) {
+	all := make(map[string]*ProjectState)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits on how the supervisor restarts failed instances
+type SuperviseOptions struct {
+	// how often the project is compared against the config
+	Interval time.Duration
+	// wait before the first restart, doubled for each restart after that
+	Backoff time.Duration
+	// the longest wait between restarts
+	MaxBackoff time.Duration
+	// give up on an instance after this many restarts in a row, 0 for no limit
+	MaxRestarts int
+}
+
+// Restart history of a single instance
+type restartRecord struct {
+	restarts    int
+	lastRestart time.Time
+	gaveUp      bool
+}
+
+const (
+	// how far back docker events are replayed at startup, to find containers
+	// that were stopped on purpose before supervision began
+	superviseEventLookback = "24h"
+	// time for the events of an exit to arrive before the exit is acted on
+	superviseEventSettle = 2 * time.Second
+)
+
+type supervisor struct {
+	opts    SuperviseOptions
+	records map[string]*restartRecord
+	// when supervision began, earlier events don't run hooks
+	started time.Time
+
+	lock sync.Mutex
+	// the config as of the last check, used by event hooks
+	settings *ProjectConfig
+	// containers that were stopped or killed, rather than dying by themselves,
+	// since they last started
+	stopped map[string]bool
+}
+
+// Compare the project with the config every interval, running missing
+// instances and starting crashed ones again. Unlike docker restart policies
+// this runs the usual hooks and recreates removed containers.
+//
+// A container counts as crashed when it exited with a non-zero code without
+// a kill or stop event, so ones stopped on purpose, eg with `capitan stop`,
+// are left alone.
+//
+// Docker events for the project run the on.<action> hooks of their services.
+//
+// Runs until interrupted.
+func runSupervisor(opts SuperviseOptions) {
+	s := &supervisor{
+		opts:    opts,
+		records: make(map[string]*restartRecord),
+		started: time.Now(),
+		stopped: make(map[string]bool),
+	}
+	for ; ; time.Sleep(opts.Interval) {
+		settings, err := loadSettings(args)
+		if err != nil {
+			Warning.Println("Failed to read config:", err)
+			continue
+		}
+		s.lock.Lock()
+		first := s.settings == nil
+		s.settings = settings
+		s.lock.Unlock()
+
+		if first {
+			go followProjectEvents(settings.ProjectName, superviseEventLookback, s.handleEvent)
+			// let the replayed events arrive before judging any exits
+			time.Sleep(superviseEventSettle)
+		}
+
+		s.check(settings.ContainerList)
+	}
+}
+
+// Track deliberate stops and run the event's hook
+func (s *supervisor) handleEvent(event *helpers.ContainerEvent) {
+	if event.Type != "container" {
+		return
+	}
+
+	s.lock.Lock()
+	switch event.Action {
+	case "kill", "stop":
+		s.stopped[event.Name] = true
+	case "start", "destroy":
+		delete(s.stopped, event.Name)
+	}
+	settings := s.settings
+	s.lock.Unlock()
+
+	// replayed events are only used to find stopped containers
+	if event.Time.Before(s.started) {
+		return
+	}
+	settings.RunEventHook(event, os.Stdout)
+}
+
+// Whether a container was stopped or killed since it last started
+func (s *supervisor) stoppedOnPurpose(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stopped[name]
+}
+
+func (s *supervisor) check(settings SettingsList) {
+	for _, set := range settings {
+		if set.Remove {
+			// runs in the foreground, nothing to keep running
+			continue
+		}
+		key := set.ServiceName + set.ProjectNameSeparator + strconv.Itoa(set.InstanceNumber)
+		record := s.records[key]
+		if record == nil {
+			record = new(restartRecord)
+			s.records[key] = record
+		}
+
+		var reason string
+		switch {
+		case set.State.ID == "":
+			reason = "missing"
+		case set.State.Running:
+			// running long enough after a restart to count as recovered
+			if record.restarts > 0 && time.Since(record.lastRestart) > s.opts.MaxBackoff {
+				ContainerInfoLog(set.Name, "Recovered after", record.restarts, "restart(s)")
+				*record = restartRecord{}
+			}
+			continue
+		default:
+			status, err := helpers.GetContainerStatus(set.Name)
+			if err != nil {
+				Debug.Println("Failed to inspect", set.Name, err)
+				continue
+			}
+			if (status.Status != "exited" || status.ExitCode == 0) && status.Status != "dead" {
+				// a job that finished
+				continue
+			}
+			if finished, err := helpers.ContainerFinishedAt(set.Name); err == nil && time.Since(finished) < superviseEventSettle {
+				// the kill or stop event may not have arrived yet
+				continue
+			}
+			if s.stoppedOnPurpose(set.Name) {
+				Debug.Println(set.Name, "was stopped, leaving it")
+				continue
+			}
+			reason = "exited with code " + strconv.Itoa(status.ExitCode)
+		}
+
+		if record.gaveUp {
+			continue
+		}
+		if s.opts.MaxRestarts > 0 && record.restarts >= s.opts.MaxRestarts {
+			Error.Printf("%s %s, giving up after %d restarts\n", set.Name, reason, record.restarts)
+			record.gaveUp = true
+			continue
+		}
+		if wait := s.backoff(record.restarts); time.Since(record.lastRestart) < wait {
+			Debug.Println(set.Name, reason+", next restart in", wait-time.Since(record.lastRestart))
+			continue
+		}
+
+		record.restarts++
+		record.lastRestart = time.Now()
+		Warning.Printf("%s %s, restarting (attempt %d)\n", set.Name, reason, record.restarts)
+		if err := s.remediate(set); err != nil {
+			Error.Println("Failed to restart", set.Name+":", err)
+		}
+	}
+}
+
+// Time to wait after the given number of restarts before restarting again
+func (s *supervisor) backoff(restarts int) time.Duration {
+	if restarts == 0 {
+		return 0
+	}
+	wait := s.opts.Backoff
+	for i := 1; i < restarts && wait < s.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > s.opts.MaxBackoff {
+		wait = s.opts.MaxBackoff
+	}
+	return wait
+}
+
+// Run a missing instance, or start a crashed one, with its hooks
+func (s *supervisor) remediate(set *container.Container) error {
+	if dryRun {
+		ContainerInfoLog(set.Name, "Starting...")
+		return nil
+	}
+	wg := sync.WaitGroup{}
+	if set.State.ID == "" {
+		return set.Run(false, false, &wg)
+	}
+	return set.Start(false, &wg)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/byrnedo/capitan/container"
+	. "github.com/byrnedo/capitan/logger"
+	"sort"
+	"time"
+)
+
+// The parts of a service definition that `up` acts on
+type serviceFingerprint struct {
+	container.Container
+	HookScripts map[string][]string
+}
+
+// The parts of a project definition that `up` acts on
+type projectFingerprint struct {
+	ProjectName   string
+	BlueGreenMode bool
+	Networks      []*Network
+	Volumes       []*Volume
+	HookScripts   map[string][]string
+	Services      []serviceFingerprint
+}
+
+// Hash the parsed config, leaving out anything that changes as a result of
+// deploying it, such as container state and colour, so that only edits to
+// the config give a new fingerprint
+func configFingerprint(settings *ProjectConfig) (string, error) {
+	fp := projectFingerprint{
+		ProjectName:   settings.ProjectName,
+		BlueGreenMode: settings.BlueGreenMode,
+		Networks:      settings.Networks,
+		Volumes:       settings.Volumes,
+		HookScripts:   make(map[string][]string, len(settings.Hooks)),
+		Services:      make([]serviceFingerprint, 0, len(settings.ContainerList)),
+	}
+	for name, hook := range settings.Hooks {
+		fp.HookScripts[name] = hook.Scripts
+	}
+
+	// the list is built from a map, so put it in a stable order first
+	services := make(SettingsList, len(settings.ContainerList))
+	copy(services, settings.ContainerList)
+	sort.Sort(services)
+
+	for _, ctr := range services {
+		service := serviceFingerprint{
+			Container:   *ctr,
+			HookScripts: make(map[string][]string, len(ctr.Hooks)),
+		}
+		for name, hook := range ctr.Hooks {
+			service.HookScripts[name] = hook.Scripts
+		}
+		service.Name = ""
+		service.State = nil
+		service.Hooks = nil
+		service.RunArguments = nil
+		service.ScaleSource = ""
+		service.InstanceVolumes = make([]container.InstanceVolume, len(ctr.InstanceVolumes))
+		for i, vol := range ctr.InstanceVolumes {
+			service.InstanceVolumes[i] = container.InstanceVolume{Template: vol.Template, Mount: vol.Mount}
+		}
+		fp.Services = append(fp.Services, service)
+	}
+
+	out, err := json.Marshal(fp)
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum(out)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Run `up` then re-run the config command every interval, running `up` again
+// whenever the parsed config changes. A change has to stay the same for the
+// debounce period before it is applied, so a burst of edits is deployed once.
+//
+// Errors parsing or deploying the config are logged and the watch carries on.
+// Runs until interrupted.
+func runWatch(interval time.Duration, debounce time.Duration) {
+	var (
+		applied   string
+		pending   string
+		changedAt time.Time
+		first     = true
+	)
+
+	for ; ; time.Sleep(interval) {
+		settings, err := loadSettings(args)
+		if err != nil {
+			Warning.Println("Failed to read config:", err)
+			continue
+		}
+		current, err := configFingerprint(settings)
+		if err != nil {
+			Warning.Println("Failed to fingerprint config:", err)
+			continue
+		}
+
+		if current == applied {
+			pending = ""
+			continue
+		}
+		if !first {
+			if current != pending {
+				Info.Println("Config changed, waiting for it to settle...")
+				pending = current
+				changedAt = time.Now()
+			}
+			if time.Since(changedAt) < debounce {
+				continue
+			}
+			Info.Println("Config changed, updating...")
+		}
+		first = false
+
+		exitCode, err := upProject(settings)
+		if err != nil {
+			Error.Println(err)
+		} else if exitCode != 0 {
+			Warning.Println("Up finished with exit code", exitCode)
+		}
+		// an update that failed isn't retried until the config changes again
+		applied = current
+		pending = ""
+		Info.Println("Watching for config changes...")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestConfigFingerprintIsStable(t *testing.T) {
+	_, restore := fakeDocker(t, "", `global project demo
+db image mysql
+cache image redis
+app image nginx
+app scale 3
+app link db
+worker image worker
+worker hook after.run echo ran`)
+	defer restore()
+
+	settings, err := loadSettings(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := configFingerprint(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the container list comes out of a map, so try a few times
+	for i := 0; i < 10; i++ {
+		settings, err = loadSettings(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := configFingerprint(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != first {
+			t.Fatalf("fingerprint changed without a config change: %s != %s", again, first)
+		}
+	}
+}
+
+func TestConfigFingerprintChanges(t *testing.T) {
+	_, restore := fakeDocker(t, "", "global project demo\napp image nginx")
+	defer restore()
+
+	settings, err := loadSettings(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := configFingerprint(settings)
+
+	cfg := "#!/bin/bash\necho global project demo\necho app image nginx:2\n"
+	if err = ioutil.WriteFile(command, []byte(cfg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if settings, err = loadSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := configFingerprint(settings)
+	if before == after {
+		t.Fatal("fingerprint didn't change with the image")
+	}
+}